@@ -2,19 +2,30 @@ package main
 
 import (
 	"net/http"
-	"sync"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-var mutex sync.Mutex                                      // For reading and updating all Refs maps and slices
+// See locks.go for the locks guarding the maps and the objects
 var UserRefs = map[uint64]*User{}                         // All users
+var OpeningRefs = map[string]*Opening{}                   // All openings, see openingKey
 var DepositRefs = map[uint64]*Deposit{}                   // All deposits
 var TransactionRefs = map[uint64]*Transaction{}           // All transactions
+var WithdrawalRefs = map[uint64]*Withdrawal{}             // All withdrawals
+var UserDepositRefs = map[uint64][]*Deposit{}             // Deposits of each user, by time
+var UserTransactionRefs = map[uint64][]*Transaction{}     // Transactions of each user, by time
+var UserWithdrawalRefs = map[uint64][]*Withdrawal{}       // Withdrawals of each user, by time
+var RoundRefs = map[string]*Round{}                       // All rounds, see roundKey
+var UserRoundRefs = map[uint64][]*Round{}                 // Rounds of each user, in the order they were opened
 var UserRefsNeedUpdate = map[uint64]*User{}               // Users that need to be updated in DB
+var OpeningRefsNeedUpdate = map[string]*Opening{}         // Openings that need to be updated in DB
 var DepositRefsNeedUpdate = map[uint64]*Deposit{}         // Deposits that need to be updated in DB
 var TransactionRefsNeedUpdate = map[uint64]*Transaction{} // Transactions that need to be updated in DB
+var WithdrawalRefsNeedUpdate = map[uint64]*Withdrawal{}   // Withdrawals that need to be updated in DB
+var RoundRefsNeedUpdate = map[string]*Round{}             // Rounds that need to be updated in DB
 
 func AddUser(c *gin.Context) {
 	var input AddUserInput
@@ -23,29 +34,54 @@ func AddUser(c *gin.Context) {
 		return
 	}
 
-	mutex.Lock()
-	defer mutex.Unlock()
+	userLock(input.Id).Lock()
+	defer userLock(input.Id).Unlock()
 
-	_, isInUserRefs := UserRefs[input.Id]
+	_, isInUserRefs := lookupUser(input.Id)
 	if isInUserRefs {
+		recordRejection(rejectDuplicateId)
 		c.JSON(http.StatusConflict, gin.H{"error": "A player with this ID already exists"})
 		return
 	}
 
-	if input.Token != "testtask" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid token"})
+	if err := CheckAmount(input.Currency, input.Balance); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if input.Balance < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Balance cannot be negative"})
 		return
 	}
 
 	newUser := new(User)
 	newUser.Id = input.Id
-	newUser.Balance = input.Balance
-	UserRefs[newUser.Id] = newUser
-	UserRefsNeedUpdate[newUser.Id] = newUser
+	newUser.CreatedAt = time.Now()
+	newUser.Wallets = map[string]*Wallet{
+		input.Currency: {Currency: input.Currency, InitialBalance: input.Balance, Balance: input.Balance},
+	}
+	opening := newOpening(c, newUser.Id, input.Currency, input.Balance, newUser.CreatedAt)
+	if !commitOperation(c, &walEntry{User: newUser, Opening: opening}) {
+		return
+	}
 
 	c.IndentedJSON(http.StatusCreated, gin.H{"error": ""})
 }
 
+// openingKey is the key of the opening of a wallet in OpeningRefs and in DB
+func openingKey(userId uint64, currency string) string {
+	return strconv.FormatUint(userId, 10) + ":" + currency
+}
+
+// newOpening returns the opening of a new wallet created by the request
+func newOpening(c *gin.Context, userId uint64, currency string, amount Money, t time.Time) *Opening {
+	o := &Opening{Key: openingKey(userId, currency), UserId: userId, Currency: currency, Amount: amount, Time: t}
+	if key, ok := c.Get("apikey"); ok {
+		o.APIKeyId = key.(*APIKey).Id
+	}
+	return o
+}
+
 func GetUser(c *gin.Context) {
 	var input GetUserInput
 	if err := c.BindJSON(&input); err != nil {
@@ -53,20 +89,58 @@ func GetUser(c *gin.Context) {
 		return
 	}
 
-	mutex.Lock()
-	defer mutex.Unlock()
+	userLock(input.Id).Lock()
+	defer userLock(input.Id).Unlock()
+
+	user, isInUserRefs := lookupUser(input.Id)
+	if !isInUserRefs {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, user)
+}
+
+func AddWallet(c *gin.Context) {
+	var input AddWalletInput
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userLock(input.UserId).Lock()
+	defer userLock(input.UserId).Unlock()
 
-	_, isInUserRefs := UserRefs[input.Id]
+	existingUser, isInUserRefs := lookupUser(input.UserId)
 	if !isInUserRefs {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
 
-	if input.Token != "testtask" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid token"})
+	user := existingUser.clone()
+	_, hasWallet := user.Wallets[input.Currency]
+	if hasWallet {
+		c.JSON(http.StatusConflict, gin.H{"error": "A wallet in this currency already exists"})
 		return
 	}
-	c.IndentedJSON(http.StatusOK, UserRefs[input.Id])
+
+	if err := CheckAmount(input.Currency, input.Balance); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if input.Balance < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Balance cannot be negative"})
+		return
+	}
+
+	user.Wallets[input.Currency] = &Wallet{Currency: input.Currency, InitialBalance: input.Balance, Balance: input.Balance}
+	opening := newOpening(c, user.Id, input.Currency, input.Balance, time.Now())
+	if !commitOperation(c, &walEntry{User: user, Opening: opening}) {
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"error": "", "balance": input.Balance})
 }
 
 func AddDeposit(c *gin.Context) {
@@ -76,43 +150,71 @@ func AddDeposit(c *gin.Context) {
 		return
 	}
 
-	mutex.Lock()
-	defer mutex.Unlock()
+	userLock(input.UserId).Lock()
+	defer userLock(input.UserId).Unlock()
 
-	_, isInUserRefs := UserRefs[input.UserId]
+	existingUser, isInUserRefs := lookupUser(input.UserId)
 	if !isInUserRefs {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
 
-	_, isInDepositRefs := DepositRefs[input.DepositId]
-	if isInDepositRefs {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "A deposit with this ID already exists"})
+	// A repeated request is answered with the original result
+	if !reserveId("deposit", input.DepositId) {
+		deposit, isInDepositRefs := lookupDeposit(input.DepositId)
+		if !isInDepositRefs {
+			recordRejection(rejectDuplicateId)
+			c.JSON(http.StatusConflict, gin.H{"error": "A deposit with this ID is being created"})
+			return
+		}
+		if !isSameDeposit(deposit, &input) {
+			recordRejection(rejectDuplicateId)
+			c.JSON(http.StatusConflict, gin.H{"error": "A different deposit with this ID already exists", "deposit": deposit})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"error": "", "balance": deposit.BalanceAfter})
+		return
+	}
+	defer releaseId("deposit", input.DepositId)
+
+	user := existingUser.clone()
+	wallet, hasWallet := user.Wallets[input.Currency]
+	if !hasWallet {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User has no wallet in this currency"})
 		return
 	}
 
-	if input.Token != "testtask" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid token"})
+	if err := CheckAmount(input.Currency, input.Amount); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if input.Amount <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Amount must be positive"})
+		return
+	}
+
+	balanceBefore := wallet.Balance
+	if err := wallet.deposit(input.Amount); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The wallet balance or totals would be out of range"})
 		return
 	}
 
 	newDeposit := new(Deposit)
 	newDeposit.DepositId = input.DepositId
 	newDeposit.UserId = input.UserId
+	newDeposit.Currency = input.Currency
 	newDeposit.Amount = input.Amount
-	newDeposit.BalanceBefore = UserRefs[input.UserId].Balance
-	newDeposit.BalanceAfter = UserRefs[input.UserId].Balance + input.Amount
+	newDeposit.BalanceBefore = balanceBefore
+	newDeposit.BalanceAfter = wallet.Balance
 	newDeposit.Time = time.Now()
 
-	DepositRefs[input.DepositId] = newDeposit
-	DepositRefsNeedUpdate[input.DepositId] = newDeposit
-
-	UserRefs[input.UserId].Balance += input.Amount
-	UserRefs[input.UserId].DepositSum += input.Amount
-	UserRefs[input.UserId].DepositCount++
-	UserRefsNeedUpdate[input.UserId] = UserRefs[input.UserId]
+	if !commitOperation(c, &walEntry{User: user, Deposit: newDeposit}) {
+		return
+	}
+	recordOperation("deposit", input.Currency, input.Amount)
 
-	c.JSON(http.StatusCreated, gin.H{"error": "", "balance": UserRefs[input.UserId].Balance})
+	c.JSON(http.StatusCreated, gin.H{"error": "", "balance": wallet.Balance})
 }
 
 func AddTransaction(c *gin.Context) {
@@ -122,58 +224,162 @@ func AddTransaction(c *gin.Context) {
 		return
 	}
 
-	mutex.Lock()
-	defer mutex.Unlock()
+	userLock(input.UserId).Lock()
+	defer userLock(input.UserId).Unlock()
 
-	_, isInUserRefs := UserRefs[input.UserId]
+	existingUser, isInUserRefs := lookupUser(input.UserId)
 	if !isInUserRefs {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
 
-	_, isInTransactionRefs := TransactionRefs[input.TransactionId]
-	if isInTransactionRefs {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "A transaction with this ID already exists"})
+	// A repeated request is answered with the original result
+	if !reserveId("transaction", input.TransactionId) {
+		transaction, isInTransactionRefs := lookupTransaction(input.TransactionId)
+		if !isInTransactionRefs {
+			recordRejection(rejectDuplicateId)
+			c.JSON(http.StatusConflict, gin.H{"error": "A transaction with this ID is being created"})
+			return
+		}
+		if !isSameTransaction(transaction, &input) {
+			recordRejection(rejectDuplicateId)
+			c.JSON(http.StatusConflict, gin.H{"error": "A different transaction with this ID already exists", "transaction": transaction})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"error": "", "balance": transaction.BalanceAfter})
+		return
+	}
+	defer releaseId("transaction", input.TransactionId)
+
+	user := existingUser.clone()
+	wallet, hasWallet := user.Wallets[input.Currency]
+	if !hasWallet {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User has no wallet in this currency"})
+		return
+	}
+
+	if err := CheckAmount(input.Currency, input.Amount); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if input.Amount < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Amount must be positive"})
 		return
 	}
 
-	if input.Token != "testtask" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid token"})
+	if input.Amount == 0 && input.Type != "Rollback" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Amount is required"})
 		return
 	}
 
-	balanceBefore := UserRefs[input.UserId].Balance
+	if len(input.RoundId) > maxRoundIdLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Round ID is too long"})
+		return
+	}
+
+	round, isInRoundRefs := lookupRound(roundKey(input.UserId, input.RoundId))
+	if isInRoundRefs && input.Type != "Rollback" {
+		if round.Status == "closed" {
+			c.JSON(http.StatusConflict, gin.H{"error": "The round is closed"})
+			return
+		}
+		if round.Currency != input.Currency {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Currency does not match the round"})
+			return
+		}
+	}
+
+	balanceBefore := wallet.Balance
+	amount := input.Amount
+	roundId := input.RoundId
+	var refTransactionId uint64
+	var err error
 
 	switch input.Type {
 	case "Win":
-		UserRefs[input.UserId].Balance += input.Amount
-		UserRefs[input.UserId].WinSum += input.Amount
-		UserRefs[input.UserId].WinCount++
+		err = wallet.win(input.Amount)
 	case "Bet":
-		if UserRefs[input.UserId].Balance < input.Amount {
+		if wallet.Balance < input.Amount {
+			recordRejection(rejectInsufficientBalance)
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient user balance"})
 			return
 		}
-		UserRefs[input.UserId].Balance -= input.Amount
-		UserRefs[input.UserId].BetSum += input.Amount
-		UserRefs[input.UserId].BetCount++
+		err = wallet.bet(input.Amount)
+	case "Rollback":
+		bet, isInTransactionRefs := lookupTransaction(input.RefTransactionId)
+		if !isInTransactionRefs || bet.UserId != input.UserId {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Transaction to roll back not found"})
+			return
+		}
+		if bet.Type != "Bet" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Only bets can be rolled back"})
+			return
+		}
+		if bet.RolledBackBy != 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "This bet is already rolled back"})
+			return
+		}
+		if bet.Currency != input.Currency || (input.Amount != 0 && input.Amount != bet.Amount) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Currency or amount does not match the bet"})
+			return
+		}
+		if input.RoundId != "" && input.RoundId != bet.RoundId {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Round does not match the bet"})
+			return
+		}
+		amount = bet.Amount
+		refTransactionId = bet.TransactionId
+		roundId = bet.RoundId // A rollback belongs to the round of its bet
+		err = wallet.rollBack(bet.Amount)
 	default:
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Incorrect transaction type"})
 		return
 	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The wallet balance or totals would be out of range"})
+		return
+	}
 
 	newTransaction := new(Transaction)
 	newTransaction.TransactionId = input.TransactionId
 	newTransaction.UserId = input.UserId
 	newTransaction.Type = input.Type
-	newTransaction.Amount = input.Amount
+	newTransaction.Currency = input.Currency
+	newTransaction.Amount = amount
+	newTransaction.RefTransactionId = refTransactionId
+	newTransaction.RoundId = roundId
 	newTransaction.BalanceBefore = balanceBefore
-	newTransaction.BalanceAfter = UserRefs[input.UserId].Balance
+	newTransaction.BalanceAfter = wallet.Balance
 	newTransaction.Time = time.Now()
 
-	TransactionRefs[input.TransactionId] = newTransaction
-	TransactionRefsNeedUpdate[input.TransactionId] = newTransaction
+	entry := &walEntry{User: user, Transaction: newTransaction}
+	if newTransaction.RoundId != "" {
+		entry.Round = walRound(roundWith(newTransaction))
+	}
+	if !commitOperation(c, entry) {
+		return
+	}
+	recordOperation(strings.ToLower(newTransaction.Type), newTransaction.Currency, newTransaction.Amount)
+
+	c.JSON(http.StatusCreated, gin.H{"error": "", "balance": wallet.Balance})
+}
+
+// isSameDeposit tells whether the request is a repetition of the one that created the deposit
+func isSameDeposit(d *Deposit, input *AddDepositInput) bool {
+	return d.UserId == input.UserId && d.Currency == input.Currency && d.Amount == input.Amount
+}
 
-	UserRefsNeedUpdate[input.UserId] = UserRefs[input.UserId]
-	c.JSON(http.StatusCreated, gin.H{"error": "", "balance": UserRefs[input.UserId].Balance})
+// isSameTransaction tells whether the request is a repetition of the one that created the transaction
+func isSameTransaction(t *Transaction, input *AddTransactionInput) bool {
+	if t.UserId != input.UserId || t.Type != input.Type || t.Currency != input.Currency {
+		return false
+	}
+	if t.Type == "Rollback" {
+		// The amount and the round of a rollback are optional and taken from the bet
+		return t.RefTransactionId == input.RefTransactionId &&
+			(input.Amount == 0 || input.Amount == t.Amount) &&
+			(input.RoundId == "" || input.RoundId == t.RoundId)
+	}
+	return t.Amount == input.Amount && t.RoundId == input.RoundId
 }
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// An API key is "<id>.<secret>". Only the SHA-256 hash of the secret is stored.
+// Keys with the "admin" role can call every endpoint, keys with the "client" role all but the /admin ones.
+type APIKey struct {
+	Id        string     `json:"id" bson:"_id"`
+	Label     string     `json:"label"`
+	Role      string     `json:"role"` // "admin" or "client"
+	Hash      string     `json:"-"`    // Hex SHA-256 of the secret
+	CreatedAt time.Time  `json:"createdat"`
+	ExpiresAt *time.Time `json:"expiresat,omitempty" bson:",omitempty"`
+	RevokedAt *time.Time `json:"revokedat,omitempty" bson:",omitempty"`
+	FromFile  bool       `json:"fromfile,omitempty" bson:"-"` // Defined in API_KEYS_FILE, cannot be managed with the API
+}
+
+var apiKeysMutex sync.RWMutex         // For reading and updating APIKeyRefs, never held during a DB write
+var APIKeyRefs = map[string]*APIKey{} // All API keys by ID
+var apiKeysChangeMutex sync.Mutex     // Serializes the key changes made with the API, held during their DB writes
+
+const apiKeySaveMaxTime = 5 * time.Second // Key changes are saved to DB before they take effect
+
+// clone returns a deep copy of the key
+func (k *APIKey) clone() *APIKey {
+	c := *k
+	return &c
+}
+
+// isActive tells whether the key can be used at the time t
+func (k *APIKey) isActive(t time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || t.Before(*k.ExpiresAt))
+}
+
+// allows tells whether the key can call the endpoints of the role
+func (k *APIKey) allows(role string) bool {
+	return k.Role == "admin" || k.Role == role
+}
+
+func hashAPIKeySecret(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+// newAPIKey generates a new key and returns it together with the full key string
+func newAPIKey(label, role string, expiresAt *time.Time) (*APIKey, string, error) {
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	key := new(APIKey)
+	key.Id = hex.EncodeToString(id)
+	key.Label = label
+	key.Role = role
+	key.CreatedAt = time.Now()
+	key.ExpiresAt = expiresAt
+	secretStr := base64.RawURLEncoding.EncodeToString(secret)
+	key.Hash = hashAPIKeySecret(secretStr)
+	return key, key.Id + "." + secretStr, nil
+}
+
+// dummyAPIKeyHash is compared against when there is no key with the requested ID,
+// so that the response time does not tell whether a key ID exists
+var dummyAPIKeyHash = hashAPIKeySecret("")
+
+// findAPIKey returns the active key matching the full key string, or nil
+func findAPIKey(fullKey string) *APIKey {
+	id, secret := fullKey, ""
+	if parts := strings.SplitN(fullKey, ".", 2); len(parts) == 2 {
+		id, secret = parts[0], parts[1]
+	}
+	apiKeysMutex.RLock()
+	key, isInAPIKeyRefs := APIKeyRefs[id]
+	apiKeysMutex.RUnlock()
+	hash := dummyAPIKeyHash
+	if isInAPIKeyRefs {
+		hash = key.Hash
+	}
+	match := subtle.ConstantTimeCompare([]byte(hashAPIKeySecret(secret)), []byte(hash)) == 1
+	if !match || !isInAPIKeyRefs || !key.isActive(time.Now()) {
+		return nil
+	}
+	return key
+}
+
+// requestAPIKey returns the key sent with the request in the "X-API-Key" or "Authorization: Bearer" header
+func requestAPIKey(c *gin.Context) string {
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return key
+	}
+	auth := c.GetHeader("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// Authenticate is a middleware that lets through only the requests with an active API key.
+// It is installed on the whole router, so it runs before any handler reads the request body or the state,
+// including the handlers of unknown routes. All rejected requests get the same response, whatever the reason:
+// no key, unknown, wrong, expired or revoked key. The key is available to the handlers as c.Get("apikey").
+func Authenticate(c *gin.Context) {
+	key := findAPIKey(requestAPIKey(c))
+	if key == nil {
+		recordRejection(rejectBadToken)
+		c.Header("WWW-Authenticate", "Bearer")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	c.Set("apikey", key)
+	c.Next()
+}
+
+// Authorize is a middleware that lets through only the requests authenticated with a key
+// allowed to call the endpoints of the role. It must run after Authenticate.
+func Authorize(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key, ok := c.Get("apikey")
+		if !ok || !key.(*APIKey).allows(role) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// LoadAPIKeysFile loads the keys defined in a JSON file: an array of objects with the APIKey fields
+// and "hash" - the hex SHA-256 of the secret (see the -gen-api-key flag)
+func LoadAPIKeysFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var entries []struct {
+		APIKey
+		Hash string `json:"hash"`
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	apiKeysMutex.Lock()
+	defer apiKeysMutex.Unlock()
+	for _, e := range entries {
+		if e.Id == "" || e.Hash == "" || (e.Role != "admin" && e.Role != "client") {
+			return fmt.Errorf("%s: key %q needs an id, a hash and the admin or client role", path, e.Id)
+		}
+		key := e.APIKey.clone()
+		key.Hash = e.Hash
+		key.FromFile = true
+		APIKeyRefs[key.Id] = key
+	}
+	return nil
+}
+
+// PrintNewAPIKey generates a key and prints it with its API_KEYS_FILE entry
+func PrintNewAPIKey(label, role string) error {
+	if role != "admin" && role != "client" {
+		return fmt.Errorf("the role must be admin or client, not %q", role)
+	}
+	key, fullKey, err := newAPIKey(label, role, nil)
+	if err != nil {
+		return err
+	}
+	entry, _ := json.Marshal(struct {
+		*APIKey
+		Hash string `json:"hash"`
+	}{key, key.Hash})
+	fmt.Println("API key:", fullKey)
+	fmt.Println("API_KEYS_FILE entry:", string(entry))
+	return nil
+}
+
+// saveAPIKey saves the key to DB and, if it succeeds, puts it into APIKeyRefs.
+// The requests are authenticated meanwhile: apiKeysMutex is only taken to put the key.
+func saveAPIKey(key *APIKey) error {
+	ctx, cancel := context.WithTimeout(context.Background(), apiKeySaveMaxTime)
+	defer cancel()
+	if err := DbStore.SaveAPIKeys(ctx, []*APIKey{key}); err != nil {
+		return err
+	}
+	apiKeysMutex.Lock()
+	APIKeyRefs[key.Id] = key
+	apiKeysMutex.Unlock()
+	return nil
+}
+
+// managedAPIKey returns the key with the ID if it can be changed with the API
+func managedAPIKey(id string) (*APIKey, int, error) {
+	apiKeysMutex.RLock()
+	key, isInAPIKeyRefs := APIKeyRefs[id]
+	apiKeysMutex.RUnlock()
+	if !isInAPIKeyRefs {
+		return nil, http.StatusNotFound, errors.New("API key not found")
+	}
+	if key.FromFile {
+		return nil, http.StatusBadRequest, errors.New("The API key is defined in the keys file")
+	}
+	if key.RevokedAt != nil {
+		return nil, http.StatusConflict, errors.New("The API key is already revoked")
+	}
+	return key, 0, nil
+}
+
+func CreateAPIKey(c *gin.Context) {
+	var input CreateAPIKeyInput
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	key, fullKey, err := newAPIKey(input.Label, input.Role, input.ExpiresAt)
+	if err != nil {
+		LogRequest(c, LevelError, "Failed to generate an API key", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	apiKeysChangeMutex.Lock()
+	defer apiKeysChangeMutex.Unlock()
+
+	if err := saveAPIKey(key); err != nil {
+		LogRequest(c, LevelError, "Failed to save an API key", "apikeyid", key.Id, "error", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	LogRequest(c, LevelInfo, "API key created", "apikeyid", key.Id, "role", key.Role)
+	c.IndentedJSON(http.StatusCreated, gin.H{"error": "", "key": fullKey, "apikey": key})
+}
+
+func RevokeAPIKey(c *gin.Context) {
+	var input APIKeyInput
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	apiKeysChangeMutex.Lock()
+	defer apiKeysChangeMutex.Unlock()
+
+	key, status, err := managedAPIKey(input.Id)
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	revoked := key.clone()
+	now := time.Now()
+	revoked.RevokedAt = &now
+	if err := saveAPIKey(revoked); err != nil {
+		LogRequest(c, LevelError, "Failed to save an API key", "apikeyid", revoked.Id, "error", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	LogRequest(c, LevelInfo, "API key revoked", "apikeyid", revoked.Id)
+	c.IndentedJSON(http.StatusOK, gin.H{"error": "", "apikey": revoked})
+}
+
+// RotateAPIKey replaces a key with a new one with the same label and role.
+// The old key stays valid for the grace period (if any), so that the clients can switch over.
+func RotateAPIKey(c *gin.Context) {
+	var input RotateAPIKeyInput
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	apiKeysChangeMutex.Lock()
+	defer apiKeysChangeMutex.Unlock()
+
+	key, status, err := managedAPIKey(input.Id)
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	newKey, fullKey, err := newAPIKey(key.Label, key.Role, input.ExpiresAt)
+	if err != nil {
+		LogRequest(c, LevelError, "Failed to generate an API key", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := saveAPIKey(newKey); err != nil {
+		LogRequest(c, LevelError, "Failed to save an API key", "apikeyid", newKey.Id, "error", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+
+	oldKey := key.clone()
+	now := time.Now()
+	if input.GracePeriod > 0 {
+		expiresAt := now.Add(time.Duration(input.GracePeriod) * time.Second)
+		if oldKey.ExpiresAt == nil || expiresAt.Before(*oldKey.ExpiresAt) {
+			oldKey.ExpiresAt = &expiresAt
+		}
+	} else {
+		oldKey.RevokedAt = &now
+	}
+	if err := saveAPIKey(oldKey); err != nil {
+		LogRequest(c, LevelError, "Failed to save an API key", "apikeyid", oldKey.Id, "error", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error(), "key": fullKey, "apikey": newKey})
+		return
+	}
+	LogRequest(c, LevelInfo, "API key rotated", "apikeyid", newKey.Id, "oldapikeyid", oldKey.Id)
+	c.IndentedJSON(http.StatusCreated, gin.H{"error": "", "key": fullKey, "apikey": newKey, "oldapikey": oldKey})
+}
+
+func ListAPIKeys(c *gin.Context) {
+	apiKeysMutex.RLock()
+	defer apiKeysMutex.RUnlock()
+
+	keys := make([]*APIKey, 0, len(APIKeyRefs))
+	for _, k := range APIKeyRefs {
+		keys = append(keys, k)
+	}
+	c.IndentedJSON(http.StatusOK, keys)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testRouteBody returns a request body for the route naming objects that exist (user 1, its deposit,
+// transaction, withdrawal and round, the API key) or that do not
+func testRouteBody(route string, exists bool, apiKeyId string) string {
+	if strings.HasPrefix(route, "/admin/apikey/") {
+		if !exists {
+			apiKeyId = "0000000000000000"
+		}
+		return fmt.Sprintf(`{"id":%q,"label":"x","role":"client"}`, apiKeyId)
+	}
+	id := 1
+	if !exists {
+		id = 999
+	}
+	return fmt.Sprintf(`{"id":%d,"userid":%d,"depositid":%d,"transactionid":%d,"withdrawalid":%d,"roundid":"r%d",`+
+		`"currency":"EUR","amount":"1","type":"Bet","status":"approved","keys":["user:%d"]}`, id, id, id, id, id, id, id)
+}
+
+// setupAuthTest returns the router with user 1 and its deposit, bet in round r1 and withdrawal, and an admin key
+func setupAuthTest(t *testing.T) (*gin.Engine, string) {
+	setupTestState(t)
+	router := NewRouter()
+	admin := newTestAPIKey(t, "admin", nil, false)
+	mustRequest(t, router, "/user/create", admin, `{"id":1,"currency":"EUR","balance":"100"}`, http.StatusCreated)
+	mustRequest(t, router, "/user/deposit", admin, `{"depositid":1,"userid":1,"currency":"EUR","amount":"10"}`, http.StatusCreated)
+	mustRequest(t, router, "/transaction", admin, `{"transactionid":1,"userid":1,"type":"Bet","currency":"EUR","amount":"5","roundid":"r1"}`, http.StatusCreated)
+	mustRequest(t, router, "/user/withdraw", admin, `{"withdrawalid":1,"userid":1,"currency":"EUR","amount":"5"}`, http.StatusCreated)
+	return router, admin
+}
+
+// protectedRoutes returns all the routes that need an API key
+func protectedRoutes(router *gin.Engine) []gin.RouteInfo {
+	var routes []gin.RouteInfo
+	for _, r := range router.Routes() {
+		if r.Path != "/healthz" && r.Path != "/readyz" {
+			routes = append(routes, r)
+		}
+	}
+	return routes
+}
+
+func TestUnauthorizedRequestsLeakNothing(t *testing.T) {
+	router, admin := setupAuthTest(t)
+	adminId := strings.SplitN(admin, ".", 2)[0]
+	past := time.Now().Add(-time.Hour)
+	credentials := []struct {
+		name   string
+		header string
+		value  string
+	}{
+		{"no key", "", ""},
+		{"malformed key", "X-API-Key", "not-a-key"},
+		{"malformed bearer", "Authorization", "Bearer not.a.key"},
+		{"other scheme", "Authorization", "Basic " + admin},
+		{"unknown key ID", "X-API-Key", "0123456789abcdef." + strings.SplitN(admin, ".", 2)[1]},
+		{"wrong secret", "X-API-Key", adminId + ".wrong"},
+		{"expired key", "X-API-Key", newTestAPIKey(t, "admin", &past, false)},
+		{"revoked key", "X-API-Key", newTestAPIKey(t, "admin", nil, true)},
+	}
+
+	// An unknown route must not be told apart from the existing ones either
+	routes := append(protectedRoutes(router), gin.RouteInfo{Method: http.MethodPost, Path: "/no/such/route"})
+	var tested []string
+	for _, route := range routes {
+		tested = append(tested, route.Path)
+		for _, cred := range credentials {
+			var bodies []string
+			for _, exists := range []bool{true, false} {
+				w := doRequestWithHeader(router, route.Method, route.Path, cred.header, cred.value, testRouteBody(route.Path, exists, adminId))
+				if w.Code != http.StatusUnauthorized {
+					t.Errorf("%s %s with %s (exists %v): got %d, want 401", route.Method, route.Path, cred.name, exists, w.Code)
+				}
+				if got := w.Header().Get("WWW-Authenticate"); got != "Bearer" {
+					t.Errorf("%s %s with %s: WWW-Authenticate %q", route.Method, route.Path, cred.name, got)
+				}
+				bodies = append(bodies, w.Body.String())
+			}
+			if bodies[0] != `{"error":"Unauthorized"}` || bodies[1] != bodies[0] {
+				t.Errorf("%s %s with %s: bodies %q and %q, want both {\"error\":\"Unauthorized\"}",
+					route.Method, route.Path, cred.name, bodies[0], bodies[1])
+			}
+		}
+	}
+
+	for _, want := range []string{"/user/get", "/transaction", "/admin/withdrawal/get", "/admin/apikey/revoke", "/admin/debug/vars", "/metrics"} {
+		found := false
+		for _, path := range tested {
+			found = found || path == want
+		}
+		if !found {
+			t.Errorf("route %s not tested", want)
+		}
+	}
+}
+
+func TestClientKeyForbiddenOnAdminRoutes(t *testing.T) {
+	router, admin := setupAuthTest(t)
+	adminId := strings.SplitN(admin, ".", 2)[0]
+	client := newTestAPIKey(t, "client", nil, false)
+
+	// The key is valid for the client routes
+	mustRequest(t, router, "/user/get", client, `{"id":1}`, http.StatusOK)
+
+	n := 0
+	for _, route := range protectedRoutes(router) {
+		if !strings.HasPrefix(route.Path, "/admin/") && route.Path != "/metrics" {
+			continue
+		}
+		n++
+		for _, exists := range []bool{true, false} {
+			w := doRequest(router, route.Method, route.Path, client, testRouteBody(route.Path, exists, adminId))
+			if w.Code != http.StatusForbidden || w.Body.String() != `{"error":"Forbidden"}` {
+				t.Errorf("%s %s with a client key (exists %v): got %d %s, want 403 {\"error\":\"Forbidden\"}",
+					route.Method, route.Path, exists, w.Code, w.Body.String())
+			}
+		}
+	}
+	if n < 10 {
+		t.Errorf("only %d admin routes tested", n)
+	}
+
+	// The admin key is let through
+	if w := doRequest(router, http.MethodGet, "/metrics", admin, ""); w.Code != http.StatusOK {
+		t.Errorf("GET /metrics with an admin key: got %d", w.Code)
+	}
+}
+
+// blockingKeyStore is a MemoryStore whose API key writes wait until release is closed
+type blockingKeyStore struct {
+	*MemoryStore
+	saving  chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingKeyStore) SaveAPIKeys(ctx context.Context, keys []*APIKey) error {
+	s.saving <- struct{}{}
+	<-s.release
+	return s.MemoryStore.SaveAPIKeys(ctx, keys)
+}
+
+func TestSlowKeyChangeDoesNotBlockAuthentication(t *testing.T) {
+	router, admin := setupAuthTest(t)
+	adminId := strings.SplitN(admin, ".", 2)[0]
+	client := newTestAPIKey(t, "client", nil, false)
+	store := &blockingKeyStore{MemoryStore: NewMemoryStore(), saving: make(chan struct{}), release: make(chan struct{})}
+	DbStore = store
+
+	other := newTestAPIKey(t, "client", nil, false)
+	otherId := strings.SplitN(other, ".", 2)[0]
+	revoked := make(chan int)
+	go func() {
+		revoked <- doRequest(router, http.MethodPost, "/admin/apikey/revoke", admin, fmt.Sprintf(`{"id":%q}`, otherId)).Code
+	}()
+	<-store.saving
+
+	// The key change waits for the DB, the other requests do not
+	for _, r := range []struct{ path, key, body string }{
+		{"/user/get", client, `{"id":1}`},
+		{"/admin/apikey/list", admin, ""},
+	} {
+		done := make(chan int, 1)
+		go func() { done <- doRequest(router, http.MethodPost, r.path, r.key, r.body).Code }()
+		select {
+		case code := <-done:
+			if code != http.StatusOK {
+				t.Errorf("%s during a key change: got %d", r.path, code)
+			}
+		case <-time.After(2 * time.Second):
+			close(store.release)
+			t.Fatalf("%s is blocked by a key change waiting for the DB", r.path)
+		}
+	}
+
+	// Another change waits for the first one
+	second := make(chan int)
+	go func() {
+		second <- doRequest(router, http.MethodPost, "/admin/apikey/revoke", admin, fmt.Sprintf(`{"id":%q}`, adminId)).Code
+	}()
+	select {
+	case <-second:
+		t.Error("a key change did not wait for the one in progress")
+	case <-store.saving:
+		t.Error("a key change did not wait for the one in progress")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(store.release)
+	<-store.saving
+	if code := <-revoked; code != http.StatusOK {
+		t.Errorf("revoke: got %d", code)
+	}
+	if code := <-second; code != http.StatusOK {
+		t.Errorf("second revoke: got %d", code)
+	}
+	if w := doRequest(router, http.MethodPost, "/user/get", other, `{"id":1}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("request with the revoked key: got %d", w.Code)
+	}
+}
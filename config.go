@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v2"
+)
+
+// The configuration is merged from, in the order of precedence: command-line flags, environment variables
+// (which may be set in a .env file), a YAML or JSON config file (-config or CONFIG_FILE) and the defaults.
+// Every setting has an environment variable, see Config.vars; its flag is the name of the variable
+// in lower case with dashes, e.g. -listen-addr for LISTEN_ADDR.
+
+type Config struct {
+	Server               ServerConfig  `yaml:"server"`
+	Storage              StorageConfig `yaml:"storage"`
+	Sync                 SyncConfig    `yaml:"sync"`
+	APIKeysFile          string        `yaml:"api_keys_file"`
+	CustomCurrencies     string        `yaml:"custom_currencies"`
+	InvariantCheckPeriod time.Duration `yaml:"invariant_check_period"`
+	LogLevel             string        `yaml:"log_level"` // See ParseLogLevel
+}
+
+type ServerConfig struct {
+	ListenAddr      string        `yaml:"listen_addr"`
+	TLSCertFile     string        `yaml:"tls_cert_file"` // HTTPS if set, together with TLSKeyFile
+	TLSKeyFile      string        `yaml:"tls_key_file"`
+	ReadTimeout     time.Duration `yaml:"read_timeout"` // 0 - no limit
+	WriteTimeout    time.Duration `yaml:"write_timeout"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout"`
+	DrainDelay      time.Duration `yaml:"drain_delay"`        // Between failing /readyz and closing the listener at shutdown
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`   // For the requests in progress to complete
+	ReadyMaxSyncAge time.Duration `yaml:"ready_max_sync_age"` // See Readiness
+	ReadyMaxQueue   int           `yaml:"ready_max_queue"`
+}
+
+type StorageConfig struct {
+	Backend string           `yaml:"backend"` // "mongo", "memory" or "file"
+	File    string           `yaml:"file"`    // For the "file" backend
+	Mongo   MongoStoreConfig `yaml:"mongo"`
+}
+
+type SyncConfig struct {
+	Durability     string        `yaml:"durability"` // "batched" or "sync", see DurabilityMode
+	Period         time.Duration `yaml:"period"`     // Of DbUpdate
+	MaxTime        time.Duration `yaml:"max_time"`   // Of a DbUpdate
+	CommitTimeout  time.Duration `yaml:"commit_timeout"`
+	LoadTimeout    time.Duration `yaml:"load_timeout"` // Of loading the state at startup
+	MaxAttempts    int           `yaml:"max_attempts"`
+	WalDir         string        `yaml:"wal_dir"`          // "none" - no WAL
+	DeadLetterFile string        `yaml:"dead_letter_file"` // "none" - no dead letters
+	FinalTimeout   time.Duration `yaml:"final_timeout"`    // Of the retries of the last sync at shutdown
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			ListenAddr:      ":8080",
+			DrainDelay:      5 * time.Second,
+			ShutdownTimeout: 5 * time.Second,
+			ReadyMaxSyncAge: 2 * time.Minute,
+			ReadyMaxQueue:   100000,
+		},
+		Storage: StorageConfig{
+			Backend: "mongo",
+			File:    "transactionapi.db",
+			Mongo: MongoStoreConfig{
+				OpeningsCollection: mongoDefaultOpeningsCollection,
+				BatchSize:          mongoDefaultBatchSize,
+				BatchTimeout:       mongoDefaultBatchTimeout,
+			},
+		},
+		Sync: SyncConfig{
+			Durability:     "batched",
+			Period:         10 * time.Second,
+			MaxTime:        time.Minute, // Each batch of a sync has its own timeout, see MONGO_BATCH_TIMEOUT
+			CommitTimeout:  5 * time.Second,
+			LoadTimeout:    5 * time.Minute,
+			MaxAttempts:    8,
+			WalDir:         "wal",
+			DeadLetterFile: "deadletters.json",
+			FinalTimeout:   10 * time.Second,
+		},
+		InvariantCheckPeriod: time.Hour,
+		LogLevel:             "info",
+	}
+}
+
+// configVar is a setting that can be given as an environment variable or a flag
+type configVar struct {
+	env   string
+	value interface{} // *string, *int or *time.Duration in the Config
+	usage string
+}
+
+func (v *configVar) flag() string {
+	return strings.ToLower(strings.ReplaceAll(v.env, "_", "-"))
+}
+
+func (v *configVar) set(s string) error {
+	switch p := v.value.(type) {
+	case *string:
+		*p = s
+	case *int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("%s: %w", v.env, err)
+		}
+		*p = n
+	case *time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("%s: %w", v.env, err)
+		}
+		*p = d
+	}
+	return nil
+}
+
+func (c *Config) vars() []configVar {
+	m := &c.Storage.Mongo
+	return []configVar{
+		{"LISTEN_ADDR", &c.Server.ListenAddr, "address the HTTP server listens on"},
+		{"TLS_CERT_FILE", &c.Server.TLSCertFile, "certificate file, the server uses HTTPS if set"},
+		{"TLS_KEY_FILE", &c.Server.TLSKeyFile, "private key file of the certificate"},
+		{"HTTP_READ_TIMEOUT", &c.Server.ReadTimeout, "max time to read a request, 0 - no limit"},
+		{"HTTP_WRITE_TIMEOUT", &c.Server.WriteTimeout, "max time to write a response, 0 - no limit"},
+		{"HTTP_IDLE_TIMEOUT", &c.Server.IdleTimeout, "max time to keep an idle connection, 0 - the read timeout"},
+		{"SHUTDOWN_DRAIN_DELAY", &c.Server.DrainDelay, "time to keep serving at shutdown after /readyz starts failing, for the load balancer to stop sending requests"},
+		{"SHUTDOWN_TIMEOUT", &c.Server.ShutdownTimeout, "max time for the requests in progress to complete at shutdown"},
+		{"READY_MAX_SYNC_AGE", &c.Server.ReadyMaxSyncAge, "the server is not ready if no sync succeeded for this long"},
+		{"READY_MAX_QUEUE", &c.Server.ReadyMaxQueue, "the server is not ready if more objects wait to be synced"},
+		{"STORAGE_BACKEND", &c.Storage.Backend, "storage backend: mongo, memory or file"},
+		{"STORAGE_FILE", &c.Storage.File, "file of the file backend"},
+		{"MONGODB_URL", &m.URL, "MongoDB connection string"},
+		{"MONGODB_USERNAME", &m.Username, "MongoDB user, if not in the connection string"},
+		{"MONGODB_PASSWORD", &m.Password, "MongoDB password"},
+		{"DBNAME", &m.DbName, "MongoDB database"},
+		{"COLLECTION_USERS_NAME", &m.UsersCollection, "collection of the users"},
+		{"COLLECTION_OPENINGS_NAME", &m.OpeningsCollection, "collection of the openings"},
+		{"COLLECTION_DEPOSITS_NAME", &m.DepositsCollection, "collection of the deposits"},
+		{"COLLECTION_TRANSACTIONS_NAME", &m.TransactionsCollection, "collection of the transactions"},
+		{"COLLECTION_WITHDRAWALS_NAME", &m.WithdrawalsCollection, "collection of the withdrawals"},
+		{"COLLECTION_ROUNDS_NAME", &m.RoundsCollection, "collection of the rounds"},
+		{"COLLECTION_APIKEYS_NAME", &m.APIKeysCollection, "collection of the API keys"},
+		{"MONGO_BATCH_SIZE", &m.BatchSize, "documents per bulk write when syncing"},
+		{"MONGO_BATCH_TIMEOUT", &m.BatchTimeout, "max time of a bulk write"},
+		{"DURABILITY", &c.Sync.Durability, "when operations are written to DB: batched or sync"},
+		{"DB_SYNC_PERIOD", &c.Sync.Period, "time between two syncs to DB"},
+		{"DB_SYNC_MAX_TIME", &c.Sync.MaxTime, "max time of a sync to DB"},
+		{"SYNC_COMMIT_TIMEOUT", &c.Sync.CommitTimeout, "max time to commit an operation with DURABILITY=sync"},
+		{"DB_LOAD_TIMEOUT", &c.Sync.LoadTimeout, "max time to load the state from DB at startup"},
+		{"SYNC_MAX_ATTEMPTS", &c.Sync.MaxAttempts, "failed DB writes of an object before it becomes a dead letter"},
+		{"WAL_DIR", &c.Sync.WalDir, "directory of the write-ahead log, none - no WAL"},
+		{"DEAD_LETTER_FILE", &c.Sync.DeadLetterFile, "file of the dead letters, none - retry forever"},
+		{"DB_SYNC_FINAL_TIMEOUT", &c.Sync.FinalTimeout, "max time to retry the last sync at shutdown"},
+		{"API_KEYS_FILE", &c.APIKeysFile, "JSON file with API keys defined outside of the DB"},
+		{"CUSTOM_CURRENCIES", &c.CustomCurrencies, "more currencies, e.g. DOGE:8,GOLD:2"},
+		{"INVARIANT_CHECK_PERIOD", &c.InvariantCheckPeriod, "time between two invariant checks, 0 - none"},
+		{"LOG_LEVEL", &c.LogLevel, "lowest level logged: debug, info, warn or error"},
+	}
+}
+
+// ConfigFlags defines the flags of the settings in fs. Their values are applied by LoadConfig.
+func ConfigFlags(fs *flag.FlagSet) {
+	for _, v := range DefaultConfig().vars() {
+		fs.String(v.flag(), "", v.usage+" (env "+v.env+")")
+	}
+}
+
+// LoadConfig merges the configuration from the flags of fs (see ConfigFlags), the environment,
+// the config file at path (CONFIG_FILE if empty, none if both are empty) and the defaults, and validates it.
+// The .env file is loaded into the environment first, if it exists.
+func LoadConfig(path string, fs *flag.FlagSet) (*Config, error) {
+	if err := godotenv.Load(); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf(".env: %w", err)
+	}
+
+	c := DefaultConfig()
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(data, c); err != nil { // JSON is YAML as well
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	vars := c.vars()
+	for i := range vars {
+		if s, ok := os.LookupEnv(vars[i].env); ok && s != "" {
+			if err := vars[i].set(s); err != nil {
+				return nil, err
+			}
+		}
+	}
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for i := range vars {
+			if vars[i].flag() == f.Name && err == nil {
+				err = vars[i].set(f.Value.String())
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c, c.validate()
+}
+
+func (c *Config) validate() error {
+	var errs []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Server.ListenAddr != "", "LISTEN_ADDR is required")
+	check((c.Server.TLSCertFile == "") == (c.Server.TLSKeyFile == ""), "TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	check(c.Server.ReadTimeout >= 0 && c.Server.WriteTimeout >= 0 && c.Server.IdleTimeout >= 0, "HTTP timeouts cannot be negative")
+	check(c.Server.DrainDelay >= 0, "SHUTDOWN_DRAIN_DELAY cannot be negative")
+	check(c.Server.ShutdownTimeout > 0, "SHUTDOWN_TIMEOUT must be positive")
+	check(c.Server.ReadyMaxSyncAge > 0, "READY_MAX_SYNC_AGE must be positive")
+	check(c.Server.ReadyMaxQueue >= 0, "READY_MAX_QUEUE cannot be negative")
+
+	switch c.Storage.Backend {
+	case "mongo":
+		m := &c.Storage.Mongo
+		check(m.URL != "", "MONGODB_URL is required")
+		check(m.DbName != "", "DBNAME is required")
+		for _, v := range c.vars() {
+			if p, ok := v.value.(*string); ok && strings.HasPrefix(v.env, "COLLECTION_") {
+				check(*p != "", "%s is required", v.env)
+			}
+		}
+		check(m.BatchSize >= 1, "MONGO_BATCH_SIZE must be at least 1")
+		check(m.BatchTimeout > 0, "MONGO_BATCH_TIMEOUT must be positive")
+	case "file":
+		check(c.Storage.File != "", "STORAGE_FILE is required")
+	case "memory":
+	default:
+		check(false, "STORAGE_BACKEND must be mongo, memory or file, not %q", c.Storage.Backend)
+	}
+
+	check(c.Sync.Durability == "batched" || c.Sync.Durability == "sync", "DURABILITY must be batched or sync, not %q", c.Sync.Durability)
+	check(c.Sync.Period > 0, "DB_SYNC_PERIOD must be positive")
+	check(c.Sync.MaxTime > 0, "DB_SYNC_MAX_TIME must be positive")
+	check(c.Sync.CommitTimeout > 0, "SYNC_COMMIT_TIMEOUT must be positive")
+	check(c.Sync.LoadTimeout > 0, "DB_LOAD_TIMEOUT must be positive")
+	check(c.Sync.MaxAttempts >= 1, "SYNC_MAX_ATTEMPTS must be at least 1")
+	check(c.Sync.WalDir != "", "WAL_DIR is required (none to disable the WAL)")
+	check(c.Sync.DeadLetterFile != "", "DEAD_LETTER_FILE is required (none to disable dead letters)")
+	check(c.Sync.FinalTimeout > 0, "DB_SYNC_FINAL_TIMEOUT must be positive")
+	check(c.InvariantCheckPeriod >= 0, "INVARIANT_CHECK_PERIOD cannot be negative")
+	_, err := ParseLogLevel(c.LogLevel)
+	check(err == nil, "LOG_LEVEL must be debug, info, warn or error, not %q", c.LogLevel)
+
+	if len(errs) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Redacted returns the configuration in YAML with the secrets replaced
+func (c *Config) Redacted() string {
+	r := *c
+	if r.Storage.Mongo.Password != "" {
+		r.Storage.Mongo.Password = "xxxxx"
+	}
+	if u, err := url.Parse(r.Storage.Mongo.URL); err == nil {
+		r.Storage.Mongo.URL = u.Redacted()
+	} else {
+		r.Storage.Mongo.URL = "xxxxx" // Unparseable, may hold a password anywhere
+	}
+	out, err := yaml.Marshal(&r)
+	if err != nil {
+		return err.Error()
+	}
+	return string(out)
+}
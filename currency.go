@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// CurrencyDecimals is the number of fractional digits allowed in the amounts of each supported currency.
+// Fiat currencies follow ISO 4217, crypto currencies are limited by MoneyDecimals.
+// More currencies can be added with the CUSTOM_CURRENCIES env variable, see LoadCustomCurrencies.
+var CurrencyDecimals = map[string]int{
+	"EUR":  2,
+	"USD":  2,
+	"GBP":  2,
+	"CHF":  2,
+	"CAD":  2,
+	"AUD":  2,
+	"SEK":  2,
+	"NOK":  2,
+	"DKK":  2,
+	"PLN":  2,
+	"CZK":  2,
+	"TRY":  2,
+	"BRL":  2,
+	"RUB":  2,
+	"INR":  2,
+	"CNY":  2,
+	"JPY":  0,
+	"KRW":  0,
+	"KWD":  3,
+	"BHD":  3,
+	"BTC":  8,
+	"ETH":  8,
+	"LTC":  8,
+	"USDT": 6,
+	"USDC": 6,
+}
+
+var currencyCodeRe = regexp.MustCompile(`^[A-Z][A-Z0-9]{2,9}$`)
+
+// LoadCustomCurrencies adds currencies from a spec like "DOGE:8,GOLD:2"
+func LoadCustomCurrencies(spec string) error {
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.Split(item, ":")
+		if len(parts) != 2 || !currencyCodeRe.MatchString(parts[0]) {
+			return fmt.Errorf("invalid custom currency %q", item)
+		}
+		decimals, err := strconv.Atoi(parts[1])
+		if err != nil || decimals < 0 || decimals > MoneyDecimals {
+			return fmt.Errorf("invalid number of decimals in custom currency %q", item)
+		}
+		CurrencyDecimals[parts[0]] = decimals
+	}
+	return nil
+}
+
+// CheckAmount returns an error if the currency is not supported or the amount is more precise than the currency allows.
+// The sign is checked by the callers: the amounts of operations must be positive, balances may be 0.
+func CheckAmount(currency string, amount Money) error {
+	decimals, ok := CurrencyDecimals[currency]
+	if !ok {
+		return fmt.Errorf("unsupported currency %q", currency)
+	}
+	if amount.Decimals() > decimals {
+		return fmt.Errorf("%s amounts can have at most %d fractional digits", currency, decimals)
+	}
+	return nil
+}
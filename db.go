@@ -2,121 +2,726 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
-	"os"
+	"sort"
 	"time"
-
-	"github.com/joho/godotenv"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-var ColUsers *mongo.Collection
-var ColDeposits *mongo.Collection
-var ColTransactions *mongo.Collection
-var DbCtxConnectCancel context.CancelFunc // Cancel function for the dbClient.Connect context
-var DbClient *mongo.Client
+var DbStore Store // The storage backend, see NewStore
 
-func DbConnect() {
+func DbConnect(cfg *StorageConfig) {
 	var err error
-	err = godotenv.Load()
+	DbStore, err = NewStore(context.Background(), cfg)
 	if err != nil {
-		log.Fatal(err)
+		LogFatal("Failed to connect to the storage backend", "error", err)
+	}
+}
+
+// DbMigrate rewrites the documents stored by older versions, if the store needs it
+func DbMigrate(defaultCurrency string) {
+	m, ok := DbStore.(Migrator)
+	if !ok {
+		LogInfo("The storage backend needs no migration")
+		return
+	}
+	if _, ok := CurrencyDecimals[defaultCurrency]; !ok {
+		LogFatal("Unsupported currency", "currency", defaultCurrency)
 	}
+	n, err := m.Migrate(context.Background(), defaultCurrency)
+	LogInfo("Migrated documents", "documents", n)
+	if err != nil {
+		LogFatal("Migration failed", "error", err)
+	}
+}
+
+// DbLoadState streams all users, deposits and transactions from the DB into the in-memory maps.
+// It must be called before the server handles requests (see SetStateLoaded), so the maps are not locked.
+func DbLoadState(maxtime time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), maxtime)
+	defer cancel()
 
-	DbClient, err = mongo.NewClient(options.Client().ApplyURI(os.Getenv("MONGODB_URL")))
+	var nUsers, nDeposits, nTransactions, nWithdrawals, nRounds int
+	LogInfo("Loading state from DB")
+	err := DbStore.LoadAll(ctx, &StoreLoader{
+		User: func(u *User) error {
+			if len(u.Wallets) == 0 {
+				return fmt.Errorf("user %d has no wallets, run with -migrate", u.Id)
+			}
+			UserRefs[u.Id] = u
+			nUsers++
+			logLoadProgress("users", nUsers)
+			return nil
+		},
+		Opening: func(o *Opening) error {
+			OpeningRefs[o.Key] = o
+			return nil
+		},
+		Deposit: func(d *Deposit) error {
+			if d.Currency == "" {
+				return fmt.Errorf("deposit %d has no currency, run with -migrate", d.DepositId)
+			}
+			DepositRefs[d.DepositId] = d
+			UserDepositRefs[d.UserId] = append(UserDepositRefs[d.UserId], d)
+			nDeposits++
+			logLoadProgress("deposits", nDeposits)
+			return nil
+		},
+		Transaction: func(t *Transaction) error {
+			if t.Currency == "" {
+				return fmt.Errorf("transaction %d has no currency, run with -migrate", t.TransactionId)
+			}
+			TransactionRefs[t.TransactionId] = t
+			UserTransactionRefs[t.UserId] = append(UserTransactionRefs[t.UserId], t)
+			nTransactions++
+			logLoadProgress("transactions", nTransactions)
+			return nil
+		},
+		Withdrawal: func(w *Withdrawal) error {
+			WithdrawalRefs[w.WithdrawalId] = w
+			UserWithdrawalRefs[w.UserId] = append(UserWithdrawalRefs[w.UserId], w)
+			nWithdrawals++
+			logLoadProgress("withdrawals", nWithdrawals)
+			return nil
+		},
+		Round: func(r *Round) error {
+			RoundRefs[r.Key] = r
+			UserRoundRefs[r.UserId] = append(UserRoundRefs[r.UserId], r)
+			nRounds++
+			logLoadProgress("rounds", nRounds)
+			return nil
+		},
+		APIKey: func(k *APIKey) error {
+			APIKeyRefs[k.Id] = k
+			return nil
+		},
+	})
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	var DbCtxConnect context.Context // This context will be active while the server runs
-	DbCtxConnect, DbCtxConnectCancel = context.WithCancel(context.Background())
+	if n := applyDeadLetters(); n > 0 {
+		LogInfo("Applied dead letters", "deadletters", n)
+	}
 
-	err = DbClient.Connect(DbCtxConnect)
+	n, err := WalReplay()
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if n > 0 {
+		LogInfo("Replayed operations from the WAL", "operations", n)
 	}
 
-	ColUsers = DbClient.Database(os.Getenv("DBNAME")).Collection(os.Getenv("COLLECTION_USERS_NAME"))
-	ColDeposits = DbClient.Database(os.Getenv("DBNAME")).Collection(os.Getenv("COLLECTION_DEPOSITS_NAME"))
-	ColTransactions = DbClient.Database(os.Getenv("DBNAME")).Collection(os.Getenv("COLLECTION_TRANSACTIONS_NAME"))
+	for _, t := range TransactionRefs {
+		if t.Type == "Rollback" {
+			if bet, ok := TransactionRefs[t.RefTransactionId]; ok {
+				bet.RolledBackBy = t.TransactionId
+			}
+		}
+	}
 
-	// err = ColUsers.Drop(dbCtxConnect)
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
-	// err = ColDeposits.Drop(dbCtxConnect)
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
-	// err = ColTransactions.Drop(dbCtxConnect)
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
+	for _, deposits := range UserDepositRefs {
+		sort.SliceStable(deposits, func(i, j int) bool { return deposits[i].Time.Before(deposits[j].Time) })
+	}
+	for _, transactions := range UserTransactionRefs {
+		sort.SliceStable(transactions, func(i, j int) bool { return transactions[i].Time.Before(transactions[j].Time) })
+	}
+	for _, withdrawals := range UserWithdrawalRefs {
+		sort.SliceStable(withdrawals, func(i, j int) bool { return withdrawals[i].Time.Before(withdrawals[j].Time) })
+	}
+	for _, rounds := range UserRoundRefs {
+		sort.Slice(rounds, func(i, j int) bool { return rounds[i].OpenedAt.Before(rounds[j].OpenedAt) })
+	}
+
+	LogInfo("Loaded state from DB", "users", nUsers, "deposits", nDeposits, "transactions", nTransactions,
+		"withdrawals", nWithdrawals, "rounds", nRounds)
+	return nil
 }
 
-func DbSyncLoop(chStopLoop chan int, period time.Duration, maxsynctime time.Duration) {
+const dbLoadProgressStep = 100000 // Log loading progress every this many documents
+
+func logLoadProgress(what string, n int) {
+	if n%dbLoadProgressStep == 0 {
+		LogInfo("Loading state from DB", what, n)
+	}
+}
+
+// DbSyncLoop calls DbUpdate every period until ctx is cancelled, and then closes stopped.
+// Cancelling ctx cuts a sync in progress short: what it did not write is left for the next one.
+// A sync in progress is completed first, so once stopped is closed no sync is running.
+func DbSyncLoop(ctx context.Context, stopped chan<- struct{}, period time.Duration, maxsynctime time.Duration) {
+	defer close(stopped)
 	TimeToSync := time.After(period)
 	for {
 		select {
 		case <-TimeToSync:
-			DbUpdate(maxsynctime)
+			DbUpdate(ctx, maxsynctime)
 			TimeToSync = time.After(period)
-		case <-chStopLoop:
-			fmt.Println("DB sync loop stopped...")
+		case <-ctx.Done():
+			LogInfo("DB sync loop stopped")
 			return
 		}
 	}
 }
 
-func DbUpdate(maxtime time.Duration) {
-	mutex.Lock()
-	UserRefsNeedUpdateCopy := map[uint64]*User{}
-	DepositRefsNeedUpdateCopy := map[uint64]*Deposit{}
-	TransactionRefsNeedUpdateCopy := map[uint64]*Transaction{}
+const finalSyncFirstDelay = time.Second // Between the first two attempts of DbFinalSync, doubled after each next one
+
+// DbFinalSync writes everything queued to DB when the server stops. The failed writes are retried
+// without the usual backoff until the deadline. It must be called once the sync loop is stopped.
+// It returns the keys (see syncKey) of the objects left unwritten and of the dead letters, sorted.
+func DbFinalSync(maxsynctime time.Duration, deadline time.Time) (unwritten []string, deadLetters []string) {
+	delay := finalSyncFirstDelay
+	for attempt := 1; ; attempt++ {
+		maxtime := time.Until(deadline)
+		if maxtime > maxsynctime {
+			maxtime = maxsynctime
+		}
+		if maxtime <= 0 {
+			break
+		}
+		syncRetryNow()
+		report := DbUpdate(context.Background(), maxtime)
+		unwritten = syncQueueKeys()
+		if len(unwritten) == 0 {
+			break
+		}
+		LogWarn("Last sync incomplete", "attempt", attempt, "failed", report.Failed, "unwritten", len(unwritten))
+		if time.Until(deadline) <= delay {
+			break
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+	unwritten = syncQueueKeys()
+
+	queueMutex.Lock()
+	for key := range DeadLetterRefs {
+		deadLetters = append(deadLetters, key)
+	}
+	queueMutex.Unlock()
+	sort.Strings(deadLetters)
+	return unwritten, deadLetters
+}
+
+// syncQueueKeys returns the keys of the objects waiting to be written to DB, sorted
+func syncQueueKeys() []string {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	var keys []string
+	for k := range UserRefsNeedUpdate {
+		keys = append(keys, syncKey("user", k))
+	}
+	for k := range OpeningRefsNeedUpdate {
+		keys = append(keys, syncKey("opening", k))
+	}
+	for k := range DepositRefsNeedUpdate {
+		keys = append(keys, syncKey("deposit", k))
+	}
+	for k := range TransactionRefsNeedUpdate {
+		keys = append(keys, syncKey("transaction", k))
+	}
+	for k := range WithdrawalRefsNeedUpdate {
+		keys = append(keys, syncKey("withdrawal", k))
+	}
+	for k := range RoundRefsNeedUpdate {
+		keys = append(keys, syncKey("round", k))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// A failed write of an object is retried by the following DbUpdate calls with exponential backoff:
+// the object stays in its NeedUpdate map, but is skipped until the delay passes. After SyncMaxAttempts
+// failures in a row the object is taken out of the queue as a dead letter, see deadletters.go.
+
+var SyncMaxAttempts = 8 // Failed writes of an object before it becomes a dead letter
+
+const syncRetryBaseDelay = 10 * time.Second // Delay after the first failure, doubled after each next one
+const syncRetryMaxDelay = 10 * time.Minute
+
+// syncRetry is the retry state of an object whose last write failed
+type syncRetry struct {
+	attempts  int
+	err       string    // Error of the last attempt
+	notBefore time.Time // Time of the next attempt
+}
+
+var syncRetries = map[string]*syncRetry{} // Retry states by syncKey, guarded by queueMutex
+
+// syncKey identifies an object in the sync queue, in the retry states and in the dead letters
+func syncKey(kind string, id interface{}) string {
+	return fmt.Sprintf("%s:%v", kind, id)
+}
+
+// syncRetryNow lets the next DbUpdate retry all the failed writes, whatever their delays
+func syncRetryNow() {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	for _, r := range syncRetries {
+		r.notBefore = time.Time{}
+	}
+}
+
+// syncDeferred tells whether the next attempt to write the object must wait
+func syncDeferred(key string, now time.Time) bool {
+	r, ok := syncRetries[key]
+	return ok && now.Before(r.notBefore)
+}
+
+// syncDone records the result of a write of an object: on a failure it schedules a retry
+// or turns the object into a dead letter. It must be called with refsMutex (read) and queueMutex held.
+func syncDone(key string, err error, object *walEntry) {
+	if err == nil {
+		delete(syncRetries, key)
+		deleteDeadLetter(key)
+		return
+	}
+
+	r, ok := syncRetries[key]
+	if !ok {
+		r = new(syncRetry)
+		syncRetries[key] = r
+	}
+	r.attempts++
+	r.err = err.Error()
+	if r.attempts >= SyncMaxAttempts {
+		if dlErr := addDeadLetter(key, r, object); dlErr == nil {
+			LogError("DB sync: moved to dead letters", append(object.logFields(), "key", key, "attempts", r.attempts, "error", err)...)
+			delete(syncRetries, key)
+			return
+		} else if dlErr != errNoDeadLetters {
+			LogError("DB sync: failed to save the dead letters", append(object.logFields(), "key", key, "error", dlErr)...)
+		}
+	}
+	delay := syncRetryBaseDelay
+	for i := 1; i < r.attempts && delay < syncRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > syncRetryMaxDelay {
+		delay = syncRetryMaxDelay
+	}
+	r.notBefore = time.Now().Add(delay)
+	LogWarn("DB sync: write failed", append(object.logFields(), "key", key, "attempt", r.attempts, "retryin", delay, "error", err)...)
+	queueForSync(object)
+}
+
+// queueForSync marks the in-memory objects with the IDs of those in the entry as needing an update in DB.
+// It must be called with refsMutex (read) and queueMutex held.
+func queueForSync(e *walEntry) {
+	if e.User != nil {
+		if u, ok := UserRefs[e.User.Id]; ok {
+			UserRefsNeedUpdate[u.Id] = u
+		}
+	}
+	if e.Opening != nil {
+		if o, ok := OpeningRefs[e.Opening.Key]; ok {
+			OpeningRefsNeedUpdate[o.Key] = o
+		}
+	}
+	if e.Deposit != nil {
+		if d, ok := DepositRefs[e.Deposit.DepositId]; ok {
+			DepositRefsNeedUpdate[d.DepositId] = d
+		}
+	}
+	if e.Transaction != nil {
+		if t, ok := TransactionRefs[e.Transaction.TransactionId]; ok {
+			TransactionRefsNeedUpdate[t.TransactionId] = t
+		}
+	}
+	if e.Withdrawal != nil {
+		if w, ok := WithdrawalRefs[e.Withdrawal.WithdrawalId]; ok {
+			WithdrawalRefsNeedUpdate[w.WithdrawalId] = w
+		}
+	}
+	if e.Round != nil {
+		if r, ok := RoundRefs[e.Round.Key]; ok {
+			RoundRefsNeedUpdate[r.Key] = r
+		}
+	}
+}
+
+// syncErrors returns the error of each of the n objects of a batch write, nil for the written ones
+func syncErrors(n int, err error) []error {
+	errs := make([]error, n)
+	if err == nil {
+		return errs
+	}
+	itemErrs, ok := err.(StoreErrors)
+	if !ok {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	for _, e := range itemErrs {
+		if ie, ok := e.(*StoreItemError); ok && ie.Index >= 0 && ie.Index < n {
+			errs[ie.Index] = ie.Err
+		}
+	}
+	return errs
+}
+
+// SyncReport is the outcome of a DbUpdate
+type SyncReport struct {
+	Flushed  int // Documents written
+	Failed   int // Documents that failed to be written, see syncDone
+	Duration time.Duration
+}
+
+var errLedgerNotSynced = errors.New("some ledger entries of the user failed to be written")
+
+// SyncCommitChunkSize limits the documents written by one Store.Commit of a DbUpdate, set from MONGO_BATCH_SIZE
+var SyncCommitChunkSize = mongoDefaultBatchSize
+
+// syncErrs holds the error of each object of a StoreBatch, nil for the written ones
+type syncErrs struct {
+	users, openings, deposits, transactions, withdrawals, rounds []error
+}
+
+// batchSyncErrs returns the errors of the objects of the batch after a write of all of them that returned err
+func batchSyncErrs(b *StoreBatch, err error) *syncErrs {
+	return &syncErrs{
+		users:        syncErrors(len(b.Users), err),
+		openings:     syncErrors(len(b.Openings), err),
+		deposits:     syncErrors(len(b.Deposits), err),
+		transactions: syncErrors(len(b.Transactions), err),
+		withdrawals:  syncErrors(len(b.Withdrawals), err),
+		rounds:       syncErrors(len(b.Rounds), err),
+	}
+}
+
+// syncSeparately writes the objects of the batch without a transaction, each on its own: the ledger entries first,
+// and then the users whose entries were all written. A sync interrupted in the middle leaves the balances
+// behind the ledger, never ahead of it.
+func syncSeparately(ctx context.Context, b *StoreBatch) *syncErrs {
+	e := &syncErrs{
+		openings:     syncErrors(len(b.Openings), DbStore.AppendOpenings(ctx, b.Openings)),
+		deposits:     syncErrors(len(b.Deposits), DbStore.AppendDeposits(ctx, b.Deposits)),
+		transactions: syncErrors(len(b.Transactions), DbStore.AppendTransactions(ctx, b.Transactions)),
+		withdrawals:  syncErrors(len(b.Withdrawals), DbStore.SaveWithdrawals(ctx, b.Withdrawals)),
+		rounds:       syncErrors(len(b.Rounds), DbStore.SaveRounds(ctx, b.Rounds)),
+	}
+	e.users = saveUsersAfterLedger(ctx, b.Users, failedLedgerUsers(b, e))
+	return e
+}
+
+// syncChunk is a part of the objects of a DbUpdate written together by a Store.Commit,
+// with the index of each of its objects in the StoreBatch of the DbUpdate
+type syncChunk struct {
+	batch                                                        StoreBatch
+	users, openings, deposits, transactions, withdrawals, rounds []int
+}
+
+func (c *syncChunk) size() int {
+	b := &c.batch
+	return len(b.Users) + len(b.Openings) + len(b.Deposits) + len(b.Transactions) + len(b.Withdrawals) + len(b.Rounds)
+}
+
+// add appends the objects of another chunk
+func (c *syncChunk) add(o *syncChunk) {
+	c.batch.Users = append(c.batch.Users, o.batch.Users...)
+	c.batch.Openings = append(c.batch.Openings, o.batch.Openings...)
+	c.batch.Deposits = append(c.batch.Deposits, o.batch.Deposits...)
+	c.batch.Transactions = append(c.batch.Transactions, o.batch.Transactions...)
+	c.batch.Withdrawals = append(c.batch.Withdrawals, o.batch.Withdrawals...)
+	c.batch.Rounds = append(c.batch.Rounds, o.batch.Rounds...)
+	c.users = append(c.users, o.users...)
+	c.openings = append(c.openings, o.openings...)
+	c.deposits = append(c.deposits, o.deposits...)
+	c.transactions = append(c.transactions, o.transactions...)
+	c.withdrawals = append(c.withdrawals, o.withdrawals...)
+	c.rounds = append(c.rounds, o.rounds...)
+}
+
+// syncChunks splits the batch into chunks of up to max documents. The objects of a user always go
+// into the same chunk, so that a user is never committed without its ledger entries; a user with
+// more than max of them gets a chunk of its own.
+func syncChunks(b *StoreBatch, max int) []*syncChunk {
+	byUser := map[uint64]*syncChunk{}
+	of := func(userId uint64) *syncChunk {
+		c, ok := byUser[userId]
+		if !ok {
+			c = new(syncChunk)
+			byUser[userId] = c
+		}
+		return c
+	}
+	for i, u := range b.Users {
+		c := of(u.Id)
+		c.batch.Users = append(c.batch.Users, u)
+		c.users = append(c.users, i)
+	}
+	for i, o := range b.Openings {
+		c := of(o.UserId)
+		c.batch.Openings = append(c.batch.Openings, o)
+		c.openings = append(c.openings, i)
+	}
+	for i, d := range b.Deposits {
+		c := of(d.UserId)
+		c.batch.Deposits = append(c.batch.Deposits, d)
+		c.deposits = append(c.deposits, i)
+	}
+	for i, t := range b.Transactions {
+		c := of(t.UserId)
+		c.batch.Transactions = append(c.batch.Transactions, t)
+		c.transactions = append(c.transactions, i)
+	}
+	for i, w := range b.Withdrawals {
+		c := of(w.UserId)
+		c.batch.Withdrawals = append(c.batch.Withdrawals, w)
+		c.withdrawals = append(c.withdrawals, i)
+	}
+	for i, r := range b.Rounds {
+		c := of(r.UserId)
+		c.batch.Rounds = append(c.batch.Rounds, r)
+		c.rounds = append(c.rounds, i)
+	}
+
+	userIds := make([]uint64, 0, len(byUser))
+	for id := range byUser {
+		userIds = append(userIds, id)
+	}
+	sort.Slice(userIds, func(i, j int) bool { return userIds[i] < userIds[j] })
+	var chunks []*syncChunk
+	current := new(syncChunk)
+	for _, id := range userIds {
+		c := byUser[id]
+		if current.size() > 0 && current.size()+c.size() > max {
+			chunks = append(chunks, current)
+			current = new(syncChunk)
+		}
+		current.add(c)
+	}
+	if current.size() > 0 {
+		chunks = append(chunks, current)
+	}
+	return chunks
+}
+
+// syncCommitted writes the batch with a Store.Commit of each chunk of it. If a commit is aborted,
+// the objects of its chunk are written separately, so that a document that cannot be written
+// does not hold back the others. Once ctx is done, the chunks left fail with its error.
+func syncCommitted(ctx context.Context, b *StoreBatch) *syncErrs {
+	e := batchSyncErrs(b, nil)
+	for _, c := range syncChunks(b, SyncCommitChunkSize) {
+		err := ctx.Err()
+		if err == nil {
+			if err = DbStore.Commit(ctx, &c.batch); err == nil {
+				continue
+			}
+		}
+		var ce *syncErrs
+		if ctx.Err() != nil {
+			ce = batchSyncErrs(&c.batch, ctx.Err())
+		} else {
+			LogWarn("DB sync: commit failed, writing the documents separately", "documents", c.size(), "error", err)
+			ce = syncSeparately(ctx, &c.batch)
+		}
+		for j, i := range c.users {
+			e.users[i] = ce.users[j]
+		}
+		for j, i := range c.openings {
+			e.openings[i] = ce.openings[j]
+		}
+		for j, i := range c.deposits {
+			e.deposits[i] = ce.deposits[j]
+		}
+		for j, i := range c.transactions {
+			e.transactions[i] = ce.transactions[j]
+		}
+		for j, i := range c.withdrawals {
+			e.withdrawals[i] = ce.withdrawals[j]
+		}
+		for j, i := range c.rounds {
+			e.rounds[i] = ce.rounds[j]
+		}
+	}
+	return e
+}
+
+// failedLedgerUsers returns the IDs of the users with ledger entries of the batch that failed to be written
+func failedLedgerUsers(b *StoreBatch, e *syncErrs) map[uint64]bool {
+	failed := map[uint64]bool{}
+	for i, o := range b.Openings {
+		if e.openings[i] != nil {
+			failed[o.UserId] = true
+		}
+	}
+	for i, d := range b.Deposits {
+		if e.deposits[i] != nil {
+			failed[d.UserId] = true
+		}
+	}
+	for i, t := range b.Transactions {
+		if e.transactions[i] != nil {
+			failed[t.UserId] = true
+		}
+	}
+	for i, w := range b.Withdrawals {
+		if e.withdrawals[i] != nil {
+			failed[w.UserId] = true
+		}
+	}
+	for i, r := range b.Rounds {
+		if e.rounds[i] != nil {
+			failed[r.UserId] = true
+		}
+	}
+	return failed
+}
+
+// saveUsersAfterLedger saves the users except the ones in failed, which get errLedgerNotSynced,
+// and returns the error of each user
+func saveUsersAfterLedger(ctx context.Context, users []*User, failed map[uint64]bool) []error {
+	errs := make([]error, len(users))
+	var save []*User
+	var index []int // Of each saved user in users
+	for i, u := range users {
+		if failed[u.Id] {
+			errs[i] = errLedgerNotSynced
+			continue
+		}
+		save = append(save, u)
+		index = append(index, i)
+	}
+	for i, err := range syncErrors(len(save), DbStore.SaveUsers(ctx, save)) {
+		errs[index[i]] = err
+	}
+	return errs
+}
+
+// DbUpdate writes the objects queued in the NeedUpdate maps to DB: in Store.Commits of up to SyncCommitChunkSize
+// documents if the store supports it, otherwise the ledger entries first and the users after them. maxtime limits the whole sync,
+// which also stops when parent is done.
+func DbUpdate(parent context.Context, maxtime time.Duration) SyncReport {
+	started := time.Now()
+	// No operation may be between its WAL entry and its queueing while the WAL is rotated,
+	// and the objects may only be copied with the locks of their users held
+	lockAllUsers()
+	walSealed := walRotate()
+	queueMutex.Lock()
+	now := time.Now()
+	users := make([]*User, 0, len(UserRefsNeedUpdate))
+	openings := make([]*Opening, 0, len(OpeningRefsNeedUpdate))
+	deposits := make([]*Deposit, 0, len(DepositRefsNeedUpdate))
+	transactions := make([]*Transaction, 0, len(TransactionRefsNeedUpdate))
 	for k, v := range UserRefsNeedUpdate {
-		UserRefsNeedUpdateCopy[k] = v
+		if !syncDeferred(syncKey("user", k), now) {
+			users = append(users, v.clone())
+			delete(UserRefsNeedUpdate, k)
+		}
+	}
+	for k, v := range OpeningRefsNeedUpdate {
+		if !syncDeferred(syncKey("opening", k), now) {
+			openings = append(openings, v)
+			delete(OpeningRefsNeedUpdate, k)
+		}
 	}
 	for k, v := range DepositRefsNeedUpdate {
-		DepositRefsNeedUpdateCopy[k] = v
+		if !syncDeferred(syncKey("deposit", k), now) {
+			deposits = append(deposits, v)
+			delete(DepositRefsNeedUpdate, k)
+		}
 	}
 	for k, v := range TransactionRefsNeedUpdate {
-		TransactionRefsNeedUpdateCopy[k] = v
+		if !syncDeferred(syncKey("transaction", k), now) {
+			transactions = append(transactions, v.clone())
+			delete(TransactionRefsNeedUpdate, k)
+		}
+	}
+	withdrawals := make([]*Withdrawal, 0, len(WithdrawalRefsNeedUpdate))
+	for k, v := range WithdrawalRefsNeedUpdate {
+		if !syncDeferred(syncKey("withdrawal", k), now) {
+			withdrawals = append(withdrawals, v.clone())
+			delete(WithdrawalRefsNeedUpdate, k)
+		}
 	}
-	UserRefsNeedUpdate = map[uint64]*User{}
-	DepositRefsNeedUpdate = map[uint64]*Deposit{}
-	TransactionRefsNeedUpdate = map[uint64]*Transaction{}
-	mutex.Unlock()
+	rounds := make([]*Round, 0, len(RoundRefsNeedUpdate))
+	for k, v := range RoundRefsNeedUpdate {
+		if !syncDeferred(syncKey("round", k), now) {
+			rounds = append(rounds, v.clone())
+			delete(RoundRefsNeedUpdate, k)
+		}
+	}
+	queueMutex.Unlock()
+	unlockAllUsers()
 
-	// If any of the User, Deposit or Transaction objects gets modified while this goroutine executes,
-	// any possible error will be corrected on the next call
+	// The objects are written as the snapshots taken above: the handlers keep changing the in-memory ones.
+	// A user snapshot is not written over a newer version of the user (see User.Version),
+	// which may have been committed in the meantime in the sync durability mode.
 
-	ctx, cancel := context.WithTimeout(context.Background(), maxtime)
+	ctx, cancel := context.WithTimeout(parent, maxtime)
 	defer cancel()
 
-	for _, u := range UserRefsNeedUpdateCopy {
-		_, err := ColUsers.ReplaceOne(ctx,
-			bson.D{{Key: "_id", Value: u.Id}},
-			u,
-			options.Replace().SetUpsert(true))
-		if err != nil {
-			fmt.Println(err)
-		}
+	batch := &StoreBatch{
+		Users:        users,
+		Openings:     openings,
+		Deposits:     deposits,
+		Transactions: transactions,
+		Withdrawals:  withdrawals,
+		Rounds:       rounds,
+	}
+	var errs *syncErrs
+	if len(users)+len(openings)+len(deposits)+len(transactions)+len(withdrawals)+len(rounds) == 0 {
+		errs = batchSyncErrs(batch, nil) // Nothing to write
+	} else if DbStore.CanCommit() {
+		// Each user is committed with its ledger entries: the DB never holds a balance without the entries behind it
+		errs = syncCommitted(ctx, batch)
+	} else {
+		errs = syncSeparately(ctx, batch)
 	}
+	userErrs, openingErrs, depositErrs, transactionErrs, withdrawalErrs, roundErrs :=
+		errs.users, errs.openings, errs.deposits, errs.transactions, errs.withdrawals, errs.rounds
 
-	for _, d := range DepositRefsNeedUpdateCopy {
-		_, err := ColDeposits.InsertOne(ctx, d)
-		if err != nil {
-			fmt.Println(err)
+	report := SyncReport{Flushed: len(users) + len(openings) + len(deposits) + len(transactions) + len(withdrawals) + len(rounds)}
+	for _, errs := range [][]error{userErrs, openingErrs, depositErrs, transactionErrs, withdrawalErrs, roundErrs} {
+		for _, err := range errs {
+			if err != nil {
+				report.Failed++
+			}
 		}
 	}
+	report.Flushed -= report.Failed
 
-	for _, d := range TransactionRefsNeedUpdateCopy {
-		_, err := ColTransactions.InsertOne(ctx, d)
-		if err != nil {
-			fmt.Println(err)
-		}
+	// The dead letters get the in-memory state of the objects, which is at least as new as the written one
+	lockAllUsers()
+	refsMutex.RLock()
+	queueMutex.Lock()
+	for i, u := range users {
+		syncDone(syncKey("user", u.Id), userErrs[i], &walEntry{User: UserRefs[u.Id].clone()})
+	}
+	for i, o := range openings {
+		syncDone(syncKey("opening", o.Key), openingErrs[i], &walEntry{Opening: o})
+	}
+	for i, d := range deposits {
+		syncDone(syncKey("deposit", d.DepositId), depositErrs[i], &walEntry{Deposit: d})
+	}
+	for i, t := range transactions {
+		syncDone(syncKey("transaction", t.TransactionId), transactionErrs[i], &walEntry{Transaction: t})
+	}
+	for i, w := range withdrawals {
+		syncDone(syncKey("withdrawal", w.WithdrawalId), withdrawalErrs[i], &walEntry{Withdrawal: WithdrawalRefs[w.WithdrawalId].clone()})
+	}
+	for i, r := range rounds {
+		syncDone(syncKey("round", r.Key), roundErrs[i], &walEntry{Round: walRound(RoundRefs[r.Key].clone())})
+	}
+	// The WAL segments can only go when nothing in them waits for a retry
+	persisted := len(syncRetries) == 0 && deadLettersFlush()
+	queueMutex.Unlock()
+	refsMutex.RUnlock()
+	unlockAllUsers()
+
+	walPersisted(walSealed, persisted)
+
+	report.Duration = time.Since(started)
+	recordSync(&report)
+	if report.Failed == 0 {
+		syncSucceeded()
+	}
+	if report.Failed > 0 {
+		LogWarn("DB sync", "flushed", report.Flushed, "failed", report.Failed, "duration", report.Duration.Round(time.Millisecond))
+	} else if report.Flushed > 0 {
+		LogInfo("DB sync", "flushed", report.Flushed, "duration", report.Duration.Round(time.Millisecond))
 	}
+	return report
 }
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// poisonStore is a MemoryStore that cannot write one deposit: a Commit holding it is aborted
+// and AppendDeposits fails it alone
+type poisonStore struct {
+	*MemoryStore
+	depositId uint64
+	commits   []*StoreBatch
+}
+
+var errPoison = errors.New("poison document")
+
+func (s *poisonStore) Commit(ctx context.Context, b *StoreBatch) error {
+	s.commits = append(s.commits, b)
+	for _, d := range b.Deposits {
+		if d.DepositId == s.depositId {
+			return fmt.Errorf("transaction aborted: %w", errPoison)
+		}
+	}
+	return s.MemoryStore.Commit(ctx, b)
+}
+
+func (s *poisonStore) AppendDeposits(ctx context.Context, deposits []*Deposit) error {
+	var errs StoreErrors
+	var good []*Deposit
+	for i, d := range deposits {
+		if d.DepositId == s.depositId {
+			errs = append(errs, &StoreItemError{Index: i, Err: errPoison})
+			continue
+		}
+		good = append(good, d)
+	}
+	if err := s.MemoryStore.AppendDeposits(ctx, good); err != nil {
+		return err
+	}
+	return errs.orNil()
+}
+
+// storedUsers returns the users in the store by ID
+func storedUsers(t *testing.T) map[uint64]*User {
+	users := map[uint64]*User{}
+	err := DbStore.LoadAll(context.Background(), &StoreLoader{
+		User:        func(u *User) error { users[u.Id] = u; return nil },
+		Opening:     func(o *Opening) error { return nil },
+		Deposit:     func(d *Deposit) error { return nil },
+		Transaction: func(tr *Transaction) error { return nil },
+		Withdrawal:  func(w *Withdrawal) error { return nil },
+		Round:       func(r *Round) error { return nil },
+		APIKey:      func(k *APIKey) error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return users
+}
+
+// storedUserIds returns the IDs of the users in the store
+func storedUserIds(t *testing.T) []uint64 {
+	var ids []uint64
+	for id := range storedUsers(t) {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func TestDbUpdateRetriesOnlyThePoisonDocument(t *testing.T) {
+	setupTestState(t)
+	store := &poisonStore{MemoryStore: NewMemoryStore(), depositId: 3}
+	DbStore = store
+	chunkSize := SyncCommitChunkSize
+	SyncCommitChunkSize = 6 // Two users with their opening and deposit
+	t.Cleanup(func() { SyncCommitChunkSize = chunkSize })
+
+	router := NewRouter()
+	admin := newTestAPIKey(t, "admin", nil, false)
+	for id := 1; id <= 5; id++ {
+		mustRequest(t, router, "/user/create", admin, fmt.Sprintf(`{"id":%d,"currency":"EUR","balance":"100"}`, id), http.StatusCreated)
+		mustRequest(t, router, "/user/deposit", admin,
+			fmt.Sprintf(`{"depositid":%d,"userid":%d,"currency":"EUR","amount":"10"}`, id, id), http.StatusCreated)
+	}
+
+	report := DbUpdate(context.Background(), time.Minute)
+	if report.Flushed != 13 || report.Failed != 2 {
+		t.Errorf("got %d flushed and %d failed, want 13 and 2 (deposit 3 and user 3)", report.Flushed, report.Failed)
+	}
+	if len(store.commits) != 3 {
+		t.Errorf("got %d commits, want 3", len(store.commits))
+	}
+	for _, b := range store.commits {
+		users := map[uint64]bool{}
+		for _, u := range b.Users {
+			users[u.Id] = true
+		}
+		for _, d := range b.Deposits {
+			if !users[d.UserId] {
+				t.Errorf("deposit %d committed without its user %d", d.DepositId, d.UserId)
+			}
+		}
+		if n := len(b.Users) + len(b.Openings) + len(b.Deposits); n > SyncCommitChunkSize {
+			t.Errorf("commit of %d documents, limit %d", n, SyncCommitChunkSize)
+		}
+	}
+
+	// User 4 shares the aborted commit with user 3, but is written
+	if got := fmt.Sprint(storedUserIds(t)); got != "[1 2 4 5]" {
+		t.Errorf("stored users %s, want [1 2 4 5]", got)
+	}
+	queueMutex.Lock()
+	var retries []string
+	for key := range syncRetries {
+		retries = append(retries, key)
+	}
+	queueMutex.Unlock()
+	sort.Strings(retries)
+	if got := fmt.Sprint(retries); got != "[deposit:3 user:3]" {
+		t.Errorf("retries %s, want [deposit:3 user:3]", got)
+	}
+}
+
+// Run with -race: the syncs run while deposits, bets and rollbacks change the users they are writing
+func TestDbUpdateDuringOperations(t *testing.T) {
+	setupTestState(t)
+	router := NewRouter()
+	admin := newTestAPIKey(t, "admin", nil, false)
+	const users, workers, rounds = 4, 8, 50
+	for id := 1; id <= users; id++ {
+		mustRequest(t, router, "/user/create", admin, fmt.Sprintf(`{"id":%d,"currency":"EUR","balance":"1000"}`, id), http.StatusCreated)
+	}
+
+	stop := make(chan struct{})
+	synced := make(chan struct{})
+	go func() {
+		defer close(synced)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				DbUpdate(context.Background(), time.Minute)
+			}
+		}
+	}()
+
+	// t.Fatal cannot be called from the workers
+	post := func(path, body string) {
+		if w := doRequest(router, http.MethodPost, path, admin, body); w.Code != http.StatusCreated {
+			t.Errorf("POST %s %s: got %d %s", path, body, w.Code, w.Body.String())
+		}
+	}
+	var nextId uint64
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				userId := (w+i)%users + 1
+				depositId := atomic.AddUint64(&nextId, 1)
+				betId := atomic.AddUint64(&nextId, 1)
+				rollbackId := atomic.AddUint64(&nextId, 1)
+				post("/user/deposit", fmt.Sprintf(`{"depositid":%d,"userid":%d,"currency":"EUR","amount":"10"}`, depositId, userId))
+				post("/transaction", fmt.Sprintf(`{"transactionid":%d,"userid":%d,"type":"Bet","currency":"EUR","amount":"7"}`, betId, userId))
+				if i%2 == 0 {
+					post("/transaction", fmt.Sprintf(
+						`{"transactionid":%d,"userid":%d,"type":"Rollback","currency":"EUR","reftransactionid":%d}`,
+						rollbackId, userId, betId))
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(stop)
+	<-synced
+
+	if r := DbUpdate(context.Background(), time.Minute); r.Failed != 0 {
+		t.Fatalf("final sync: %d documents failed", r.Failed)
+	}
+	stored := storedUsers(t)
+	for id, u := range UserRefs {
+		want, _ := json.Marshal(u)
+		got, _ := json.Marshal(stored[id])
+		if string(got) != string(want) {
+			t.Errorf("user %d: stored %s, in memory %s", id, got, want)
+		}
+	}
+	if r := CheckInvariants(); len(r.Violations) != 0 {
+		t.Errorf("%d invariant violations in memory: %+v", len(r.Violations), r.Violations)
+	}
+	r, err := CheckStoredInvariants(context.Background())
+	if err != nil || len(r.Violations) != 0 {
+		t.Errorf("stored state: %v, violations %+v", err, r)
+	}
+}
+
+// hangingStore is a MemoryStore whose commits hang until their context is done
+type hangingStore struct {
+	*MemoryStore
+	committing chan struct{}
+}
+
+func (s *hangingStore) Commit(ctx context.Context, b *StoreBatch) error {
+	s.committing <- struct{}{}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestStoppingTheSyncLoopCutsTheSyncShort(t *testing.T) {
+	setupTestState(t)
+	router := NewRouter()
+	admin := newTestAPIKey(t, "admin", nil, false)
+	mustRequest(t, router, "/user/create", admin, `{"id":1,"currency":"EUR","balance":"100"}`, http.StatusCreated)
+	memory := DbStore.(*MemoryStore)
+	DbStore = &hangingStore{MemoryStore: memory, committing: make(chan struct{}, 1)}
+
+	ctx, stop := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go DbSyncLoop(ctx, stopped, time.Millisecond, time.Hour)
+	<-DbStore.(*hangingStore).committing
+	stop()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the sync loop waits for the sync in progress")
+	}
+
+	// The last sync writes what the interrupted one did not
+	DbStore = memory
+	unwritten, deadLetters := DbFinalSync(time.Minute, time.Now().Add(time.Minute))
+	if len(unwritten) != 0 || len(deadLetters) != 0 {
+		t.Errorf("unwritten %v, dead letters %v", unwritten, deadLetters)
+	}
+	if got := fmt.Sprint(storedUserIds(t)); got != "[1]" {
+		t.Errorf("stored users %s, want [1]", got)
+	}
+}
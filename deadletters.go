@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// An object that DbUpdate failed to write syncMaxAttempts times in a row is taken out of the sync queue
+// and kept as a dead letter in a file, so that the queue and the WAL are not held by it.
+// The dead letter holds the latest state of the object. An admin can list the dead letters and re-drive them
+// back into the sync queue, e.g. after fixing the cause. A dead letter is deleted as soon as the object is
+// written to DB; for users, withdrawals and rounds that may also happen because they changed again.
+// At startup the dead letters are applied on top of the state loaded from DB, as they are newer than it.
+
+type DeadLetter struct {
+	Key        string     `json:"key"` // See syncKey
+	Attempts   int        `json:"attempts"`
+	Error      string     `json:"error"` // Error of the last attempt
+	Time       time.Time  `json:"time"`
+	RedrivenAt *time.Time `json:"redrivenat,omitempty"`
+	Object     *walEntry  `json:"object"`
+}
+
+var DeadLetterRefs = map[string]*DeadLetter{} // All dead letters by key, guarded by queueMutex
+var deadLetterPath string                     // Set by DeadLettersOpen, "" - dead letters are not kept
+var deadLettersDirty bool                     // Some dead letters were deleted, see deadLettersFlush
+
+var errNoDeadLetters = errors.New("dead letters are disabled")
+
+// DeadLettersOpen loads the dead letters from the file, if it exists. It must be called before DbLoadState.
+func DeadLettersOpen(path string) error {
+	deadLetterPath = path
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var letters []*DeadLetter
+	if err := json.Unmarshal(data, &letters); err != nil {
+		return err
+	}
+	for _, d := range letters {
+		if d.Object.Round != nil {
+			d.Object.Round.Round.Key = d.Object.Round.Key
+		}
+		DeadLetterRefs[d.Key] = d
+	}
+	return nil
+}
+
+// applyDeadLetters puts the objects of the dead letters into the in-memory state. It must be called before the server handles requests.
+func applyDeadLetters() int {
+	for _, d := range DeadLetterRefs {
+		applyOperation(d.Object, false)
+	}
+	return len(DeadLetterRefs)
+}
+
+// deadLettersSave replaces the file with the current dead letters. It must be called with queueMutex held.
+func deadLettersSave() error {
+	if deadLetterPath == "" {
+		return nil
+	}
+	letters := make([]*DeadLetter, 0, len(DeadLetterRefs))
+	for _, d := range DeadLetterRefs {
+		letters = append(letters, d)
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].Time.Before(letters[j].Time) })
+	data, err := json.MarshalIndent(letters, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write a new file and rename it over the old one, so that a crash leaves one of them whole
+	tmp, err := os.CreateTemp(filepath.Dir(deadLetterPath), filepath.Base(deadLetterPath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), deadLetterPath)
+}
+
+// addDeadLetter takes an object out of the sync queue. It must be called with queueMutex held.
+func addDeadLetter(key string, r *syncRetry, object *walEntry) error {
+	if deadLetterPath == "" {
+		return errNoDeadLetters
+	}
+	old := DeadLetterRefs[key]
+	DeadLetterRefs[key] = &DeadLetter{Key: key, Attempts: r.attempts, Error: r.err, Time: time.Now(), Object: object}
+	if err := deadLettersSave(); err != nil {
+		if old != nil {
+			DeadLetterRefs[key] = old
+		} else {
+			delete(DeadLetterRefs, key)
+		}
+		return err
+	}
+	return nil
+}
+
+// deleteDeadLetter deletes the dead letter of an object written to DB. The file is updated by deadLettersFlush.
+// It must be called with queueMutex held.
+func deleteDeadLetter(key string) {
+	if _, ok := DeadLetterRefs[key]; ok {
+		delete(DeadLetterRefs, key)
+		deadLettersDirty = true
+	}
+}
+
+// deadLettersFlush saves the dead letters if any were deleted, and tells whether the file is up to date.
+// Until it is, the WAL must be kept: a deleted dead letter left in the file would be applied at startup
+// on top of a newer state of the object. It must be called with queueMutex held.
+func deadLettersFlush() bool {
+	if !deadLettersDirty {
+		return true
+	}
+	if err := deadLettersSave(); err != nil {
+		LogError("DB sync: failed to save the dead letters", "error", err)
+		return false
+	}
+	deadLettersDirty = false
+	return true
+}
+
+func ListDeadLetters(c *gin.Context) {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+
+	letters := make([]*DeadLetter, 0, len(DeadLetterRefs))
+	for _, d := range DeadLetterRefs {
+		letters = append(letters, d)
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].Time.Before(letters[j].Time) })
+	c.IndentedJSON(http.StatusOK, letters)
+}
+
+// RedriveDeadLetters puts the objects of the dead letters with the given keys (all if none are given)
+// back into the sync queue with a fresh retry count. The dead letters are deleted once the objects are written.
+func RedriveDeadLetters(c *gin.Context) {
+	var input RedriveDeadLettersInput
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	refsMutex.RLock()
+	defer refsMutex.RUnlock()
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+
+	keys := input.Keys
+	if len(keys) == 0 {
+		for key := range DeadLetterRefs {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		if _, ok := DeadLetterRefs[key]; !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Dead letter not found: " + key})
+			return
+		}
+	}
+
+	now := time.Now()
+	for _, key := range keys {
+		d := DeadLetterRefs[key]
+		d.RedrivenAt = &now
+		delete(syncRetries, key)
+		queueForSync(d.Object) // The in-memory objects are at least as new as the dead letters
+	}
+	if err := deadLettersSave(); err != nil {
+		LogRequest(c, LevelError, "Failed to save the dead letters", "error", err)
+	}
+	LogRequest(c, LevelInfo, "Dead letters redriven", "keys", keys)
+	c.JSON(http.StatusOK, gin.H{"error": "", "redriven": len(keys)})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DurabilityMode tells when the objects changed by an operation (a deposit, a transaction and the updated user etc.)
+// are written to DB: "batched" (default) - by DbUpdate, with the WAL covering the time in between;
+// "sync" - all together in a single Store.Commit, before the operation is acknowledged
+var DurabilityMode = "batched"
+
+var syncCommitMaxTime = 5 * time.Second // Set from the configuration
+
+// commitOperation makes the operation durable and then applies it to the in-memory state.
+// The handler prepares the entry on copies of the objects it changes, so that nothing changes
+// if the operation cannot be persisted; in that case a 503 response is sent and false is returned.
+// It must be called with the locks of the users of the objects held.
+func commitOperation(c *gin.Context, e *walEntry) bool {
+	if e.User != nil {
+		e.User.Version++ // The entry holds a changed copy of the user, or a new one
+	}
+
+	if DurabilityMode != "sync" {
+		walLog(e)
+		applyOperation(e, true)
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), syncCommitMaxTime)
+	defer cancel()
+	if err := DbStore.Commit(ctx, e.batch()); err != nil {
+		LogRequest(c, LevelError, "Failed to commit an operation", append(e.logFields(), "error", err)...)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to save the operation: " + err.Error()})
+		return false
+	}
+	applyOperation(e, false)
+	return true
+}
+
+// batch returns the objects of the entry as a StoreBatch
+func (e *walEntry) batch() *StoreBatch {
+	b := new(StoreBatch)
+	if e.User != nil {
+		b.Users = []*User{e.User}
+	}
+	if e.Opening != nil {
+		b.Openings = []*Opening{e.Opening}
+	}
+	if e.Deposit != nil {
+		b.Deposits = []*Deposit{e.Deposit}
+	}
+	if e.Transaction != nil {
+		b.Transactions = []*Transaction{e.Transaction}
+	}
+	if e.Withdrawal != nil {
+		b.Withdrawals = []*Withdrawal{e.Withdrawal}
+	}
+	if e.Round != nil {
+		b.Rounds = []*Round{e.Round.Round}
+	}
+	return b
+}
+
+// applyOperation puts the objects of the entry into the in-memory state, replacing the contents of the
+// existing users, withdrawals and rounds. With needUpdate the objects are also marked for DbUpdate.
+// It must be called with the locks of the users of the objects held, or before the server handles requests.
+func applyOperation(e *walEntry, needUpdate bool) {
+	refsMutex.Lock()
+	defer refsMutex.Unlock()
+
+	queued := new(walEntry) // The objects to mark for DbUpdate
+	if u := e.User; u != nil {
+		if existing, ok := UserRefs[u.Id]; ok {
+			*existing = *u
+		} else {
+			UserRefs[u.Id] = u
+		}
+		queued.User = u
+	}
+	if o := e.Opening; o != nil {
+		if _, ok := OpeningRefs[o.Key]; !ok {
+			OpeningRefs[o.Key] = o
+			queued.Opening = o
+		}
+	}
+	if d := e.Deposit; d != nil {
+		if _, ok := DepositRefs[d.DepositId]; !ok {
+			DepositRefs[d.DepositId] = d
+			UserDepositRefs[d.UserId] = append(UserDepositRefs[d.UserId], d)
+			queued.Deposit = d
+		}
+	}
+	if t := e.Transaction; t != nil {
+		if _, ok := TransactionRefs[t.TransactionId]; !ok {
+			TransactionRefs[t.TransactionId] = t
+			UserTransactionRefs[t.UserId] = append(UserTransactionRefs[t.UserId], t)
+			queued.Transaction = t
+		}
+		if bet, ok := TransactionRefs[t.RefTransactionId]; ok && t.Type == "Rollback" {
+			bet.RolledBackBy = t.TransactionId
+		}
+	}
+	if w := e.Withdrawal; w != nil {
+		if existing, ok := WithdrawalRefs[w.WithdrawalId]; ok {
+			*existing = *w
+		} else {
+			WithdrawalRefs[w.WithdrawalId] = w
+			UserWithdrawalRefs[w.UserId] = append(UserWithdrawalRefs[w.UserId], w)
+		}
+		queued.Withdrawal = w
+	}
+	if e.Round != nil {
+		r := e.Round.Round
+		r.Key = e.Round.Key
+		if existing, ok := RoundRefs[r.Key]; ok {
+			*existing = *r
+		} else {
+			RoundRefs[r.Key] = r
+			UserRoundRefs[r.UserId] = append(UserRoundRefs[r.UserId], r)
+		}
+		queued.Round = e.Round
+	}
+
+	if needUpdate {
+		queueMutex.Lock()
+		queueForSync(queued)
+		queueMutex.Unlock()
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /healthz (liveness) and /readyz (readiness) are for orchestrators and need no API key.
+// The server starts listening before the state is loaded, so that /healthz answers during a long startup.
+// Until the state is loaded the other endpoints get 503.
+
+const healthPingMaxTime = 2 * time.Second
+
+var stateLoaded int32     // Set by SetStateLoaded
+var shuttingDown int32    // Set by SetShuttingDown
+var lastSyncSuccess int64 // Time of the last DbUpdate without failures, in Unix nanoseconds
+
+// Readiness limits, set from the configuration
+var readyMaxSyncAge = 2 * time.Minute
+var readyMaxQueue = 100000
+
+// SetStateLoaded is called once the server is ready to handle requests
+func SetStateLoaded() {
+	atomic.StoreInt64(&lastSyncSuccess, time.Now().UnixNano()) // Nothing is waiting to be synced yet
+	atomic.StoreInt32(&stateLoaded, 1)
+}
+
+// SetShuttingDown makes the server not ready, so that no more requests are sent to it
+func SetShuttingDown() {
+	atomic.StoreInt32(&shuttingDown, 1)
+}
+
+// syncSucceeded records a DbUpdate that wrote everything it took
+func syncSucceeded() {
+	atomic.StoreInt64(&lastSyncSuccess, time.Now().UnixNano())
+}
+
+// queueSize returns the number of objects waiting to be written to DB
+func queueSize() int {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	return len(UserRefsNeedUpdate) + len(OpeningRefsNeedUpdate) + len(DepositRefsNeedUpdate) +
+		len(TransactionRefsNeedUpdate) + len(WithdrawalRefsNeedUpdate) + len(RoundRefsNeedUpdate)
+}
+
+// RequireState is a middleware that rejects the requests until the state is loaded
+func RequireState(c *gin.Context) {
+	if atomic.LoadInt32(&stateLoaded) == 0 {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "The server is starting"})
+		return
+	}
+	c.Next()
+}
+
+func Liveness(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Readiness responds 200 if the server can handle requests, 503 otherwise, with the result of each check
+func Readiness(c *gin.Context) {
+	checks := gin.H{}
+	ready := true
+	fail := func(check, problem string) {
+		checks[check] = problem
+		ready = false
+	}
+
+	if atomic.LoadInt32(&shuttingDown) != 0 {
+		fail("shutdown", "shutting down")
+	} else {
+		checks["shutdown"] = "ok"
+	}
+
+	if atomic.LoadInt32(&stateLoaded) == 0 {
+		fail("state", "loading")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"ready": false, "checks": checks})
+		return
+	}
+	checks["state"] = "ok"
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), healthPingMaxTime)
+	defer cancel()
+	if err := DbStore.Ping(ctx); err != nil {
+		// The error can name the DB hosts, and /readyz needs no API key
+		LogRequest(c, LevelWarn, "Readiness: DB ping failed", "error", err)
+		fail("db", "unreachable")
+	} else {
+		checks["db"] = "ok"
+	}
+
+	age := time.Since(time.Unix(0, atomic.LoadInt64(&lastSyncSuccess))).Round(time.Second)
+	checks["lastsync"] = age.String() + " ago"
+	if age > readyMaxSyncAge {
+		fail("sync", "no successful sync for "+age.String())
+	} else {
+		checks["sync"] = "ok"
+	}
+
+	queued := queueSize()
+	checks["queued"] = queued
+	if queued > readyMaxQueue {
+		fail("queue", "too many objects waiting to be synced")
+	} else {
+		checks["queue"] = "ok"
+	}
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, gin.H{"ready": ready, "checks": checks})
+}
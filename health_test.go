@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// downStore is a MemoryStore whose pings fail with an error naming the DB hosts
+type downStore struct {
+	*MemoryStore
+}
+
+func (s *downStore) Ping(ctx context.Context) error {
+	return errors.New("server selection error: mongo-0.internal:27017, replica set rs0")
+}
+
+func TestReadinessHidesTheDbError(t *testing.T) {
+	setupTestState(t)
+	var logs bytes.Buffer
+	logOutput = &logs
+	DbStore = &downStore{NewMemoryStore()}
+
+	w := doRequest(NewRouter(), http.MethodGet, "/readyz", "", "")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got %d, want 503", w.Code)
+	}
+	if body := w.Body.String(); !strings.Contains(body, `"db":"unreachable"`) || strings.Contains(body, "mongo-0") {
+		t.Errorf("body %s, want the db check unreachable without the error", body)
+	}
+	if !strings.Contains(logs.String(), "mongo-0.internal") {
+		t.Errorf("the ping error is not logged: %s", logs.String())
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setupTestState resets the in-memory state to an empty one on the memory backend, without the WAL
+// and the dead letters, as after SetStateLoaded
+func setupTestState(tb testing.TB) {
+	tb.Helper()
+	gin.SetMode(gin.TestMode)
+	logOutput = io.Discard
+
+	refsMutex.Lock()
+	queueMutex.Lock()
+	UserRefs = map[uint64]*User{}
+	OpeningRefs = map[string]*Opening{}
+	DepositRefs = map[uint64]*Deposit{}
+	TransactionRefs = map[uint64]*Transaction{}
+	WithdrawalRefs = map[uint64]*Withdrawal{}
+	UserDepositRefs = map[uint64][]*Deposit{}
+	UserTransactionRefs = map[uint64][]*Transaction{}
+	UserWithdrawalRefs = map[uint64][]*Withdrawal{}
+	RoundRefs = map[string]*Round{}
+	UserRoundRefs = map[uint64][]*Round{}
+	UserRefsNeedUpdate = map[uint64]*User{}
+	OpeningRefsNeedUpdate = map[string]*Opening{}
+	DepositRefsNeedUpdate = map[uint64]*Deposit{}
+	TransactionRefsNeedUpdate = map[uint64]*Transaction{}
+	WithdrawalRefsNeedUpdate = map[uint64]*Withdrawal{}
+	RoundRefsNeedUpdate = map[string]*Round{}
+	reservedIds = map[string]bool{}
+	syncRetries = map[string]*syncRetry{}
+	DeadLetterRefs = map[string]*DeadLetter{}
+	deadLetterPath = ""
+	queueMutex.Unlock()
+	refsMutex.Unlock()
+
+	apiKeysMutex.Lock()
+	APIKeyRefs = map[string]*APIKey{}
+	apiKeysMutex.Unlock()
+
+	DbStore = NewMemoryStore()
+	DurabilityMode = "batched"
+	walEnabled = false
+	SetStateLoaded()
+}
+
+// newTestAPIKey adds an API key with the role and returns the full key to send with the requests
+func newTestAPIKey(tb testing.TB, role string, expiresAt *time.Time, revoked bool) string {
+	tb.Helper()
+	key, fullKey, err := newAPIKey("test", role, expiresAt)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if revoked {
+		now := time.Now()
+		key.RevokedAt = &now
+	}
+	apiKeysMutex.Lock()
+	APIKeyRefs[key.Id] = key
+	apiKeysMutex.Unlock()
+	return fullKey
+}
+
+// doRequest sends a request to the router, with the API key in X-API-Key if not empty
+func doRequest(router http.Handler, method, path, key, body string) *httptest.ResponseRecorder {
+	return doRequestWithHeader(router, method, path, "X-API-Key", key, body)
+}
+
+// doRequestWithHeader sends a request to the router, with the header if the value is not empty
+func doRequestWithHeader(router http.Handler, method, path, header, value, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if value != "" {
+		req.Header.Set(header, value)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// mustRequest sends a request and fails the test if the response has another status
+func mustRequest(tb testing.TB, router http.Handler, path, key, body string, status int) {
+	tb.Helper()
+	if w := doRequest(router, http.MethodPost, path, key, body); w.Code != status {
+		tb.Fatalf("POST %s %s: got %d %s, want %d", path, body, w.Code, w.Body.String(), status)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const historyDefaultLimit = 50
+
+// The cursor of a history page is the position in the user's list (UserDepositRefs or UserTransactionRefs)
+// where the next page starts, together with the sort order. The lists are append-only, so the positions are stable.
+
+func encodeHistoryCursor(order string, pos int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(order + ":" + strconv.Itoa(pos)))
+}
+
+func decodeHistoryCursor(cursor, order string) (int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil {
+		parts := strings.SplitN(string(b), ":", 2)
+		if len(parts) == 2 && parts[0] == order {
+			if pos, err := strconv.Atoi(parts[1]); err == nil && pos >= 0 {
+				return pos, nil
+			}
+		}
+	}
+	return 0, errors.New("Invalid cursor")
+}
+
+// historyPage selects a page of the user's list of n records sorted by time. It returns the positions
+// of the records of the page and the cursor of the next page ("" if it is the last one).
+func historyPage(input *HistoryInput, n int, timeAt func(i int) time.Time, match func(i int) bool) ([]int, string, error) {
+	order := input.Order
+	if order == "" {
+		order = "desc"
+	}
+	limit := input.Limit
+	if limit == 0 {
+		limit = historyDefaultLimit
+	}
+
+	// The time window limits the part of the list to look at: [lo, hi)
+	lo, hi := 0, n
+	if input.From != nil {
+		lo = sort.Search(n, func(i int) bool { return !timeAt(i).Before(*input.From) })
+	}
+	if input.To != nil {
+		hi = sort.Search(n, func(i int) bool { return timeAt(i).After(*input.To) })
+	}
+
+	var page []int
+	if order == "asc" {
+		start := lo
+		if input.Cursor != "" {
+			pos, err := decodeHistoryCursor(input.Cursor, order)
+			if err != nil {
+				return nil, "", err
+			}
+			if pos > start {
+				start = pos
+			}
+		}
+		for i := start; i < hi; i++ {
+			if !match(i) {
+				continue
+			}
+			if len(page) == limit {
+				return page, encodeHistoryCursor(order, i), nil
+			}
+			page = append(page, i)
+		}
+	} else {
+		start := hi - 1
+		if input.Cursor != "" {
+			pos, err := decodeHistoryCursor(input.Cursor, order)
+			if err != nil {
+				return nil, "", err
+			}
+			if pos < start {
+				start = pos
+			}
+		}
+		for i := start; i >= lo; i-- {
+			if !match(i) {
+				continue
+			}
+			if len(page) == limit {
+				return page, encodeHistoryCursor(order, i), nil
+			}
+			page = append(page, i)
+		}
+	}
+	return page, "", nil
+}
+
+// matchesAmount tells whether the amount is within the range of the input
+func (input *HistoryInput) matchesAmount(amount Money) bool {
+	return (input.MinAmount == nil || amount >= *input.MinAmount) && (input.MaxAmount == nil || amount <= *input.MaxAmount)
+}
+
+func GetUserDeposits(c *gin.Context) {
+	var input HistoryInput
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userLock(input.UserId).Lock()
+	defer userLock(input.UserId).Unlock()
+
+	_, isInUserRefs := lookupUser(input.UserId)
+	if !isInUserRefs {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	deposits := lookupUserDeposits(input.UserId)
+	page, next, err := historyPage(&input, len(deposits),
+		func(i int) time.Time { return deposits[i].Time },
+		func(i int) bool {
+			d := deposits[i]
+			return (input.Currency == "" || d.Currency == input.Currency) && input.matchesAmount(d.Amount)
+		})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result := make([]*Deposit, len(page))
+	for i, pos := range page {
+		result[i] = deposits[pos]
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"deposits": result, "nextcursor": next})
+}
+
+func GetUserTransactions(c *gin.Context) {
+	var input HistoryInput
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userLock(input.UserId).Lock()
+	defer userLock(input.UserId).Unlock()
+
+	_, isInUserRefs := lookupUser(input.UserId)
+	if !isInUserRefs {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	transactions := lookupUserTransactions(input.UserId)
+	page, next, err := historyPage(&input, len(transactions),
+		func(i int) time.Time { return transactions[i].Time },
+		func(i int) bool {
+			t := transactions[i]
+			return (input.Type == "" || t.Type == input.Type) &&
+				(input.Currency == "" || t.Currency == input.Currency) &&
+				input.matchesAmount(t.Amount)
+		})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result := make([]*Transaction, len(page))
+	for i, pos := range page {
+		result[i] = transactions[pos]
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"transactions": result, "nextcursor": next})
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The invariant checker recomputes the wallets of the users from their ledger - openings, deposits,
+// transactions and withdrawals - and reports the wallets that do not match it:
+// - the counts and sums of the wallet must be those of the ledger entries (rolled back bets and rejected
+// withdrawals excluded), and the reserved amount that of the pending and approved withdrawals;
+// - the entries must chain: each one starts with the balance the previous one left, and the last one
+// leaves the balance of the wallet;
+// - the balance must be the initial balance of the wallet + deposits - bets + wins - withdrawals.
+// The initial balance is that of the opening of the wallet. Wallets created by older versions have no opening,
+// their initial balance is taken as the balance before their first ledger entry.
+// It checks either the in-memory state or the state stored in DB.
+
+const invariantsMaxLogged = 100 // Violations logged by a background check
+
+type InvariantViolation struct {
+	UserId   uint64 `json:"userid"`
+	Currency string `json:"currency"`
+	Problem  string `json:"problem"`
+}
+
+type InvariantReport struct {
+	Source     string               `json:"source"` // "memory" or "db"
+	Time       time.Time            `json:"time"`
+	Duration   time.Duration        `json:"duration"`
+	Users      int                  `json:"users"` // Checked
+	Violations []InvariantViolation `json:"violations"`
+}
+
+// The results of the last checks, served with the other expvar variables on GET /admin/debug/vars
+var invariantMetrics = expvar.NewMap("invariants")
+
+// userLedger is a user with all its ledger entries
+type userLedger struct {
+	user         *User
+	openings     []*Opening
+	deposits     []*Deposit
+	transactions []*Transaction
+	withdrawals  []*Withdrawal
+}
+
+// ledgerEntry is a change of the balance of a wallet by a ledger entry
+type ledgerEntry struct {
+	what          string
+	time          time.Time
+	balanceBefore Money
+	balanceAfter  Money
+}
+
+// walletTotals are the counts and sums of a wallet recomputed from the ledger
+type walletTotals struct {
+	opening                                       *Opening
+	deposits, bets, wins, withdrawals             uint64
+	depositSum, betSum, winSum, withdrawSum, held Money
+	entries                                       []ledgerEntry
+	outOfRange                                    bool // A sum is out of the range of Money
+}
+
+// add adds the amount to the sum, or sets outOfRange
+func (t *walletTotals) add(sum *Money, amount Money) {
+	s, err := sum.Add(amount)
+	if err != nil {
+		t.outOfRange = true
+		return
+	}
+	*sum = s
+}
+
+// check returns the violations of the invariants by the wallets of the user
+func (l *userLedger) check() []InvariantViolation {
+	totals := map[string]*walletTotals{}
+	wallet := func(currency string) *walletTotals {
+		t, ok := totals[currency]
+		if !ok {
+			t = new(walletTotals)
+			totals[currency] = t
+		}
+		return t
+	}
+
+	for _, o := range l.openings {
+		t := wallet(o.Currency)
+		t.opening = o
+		t.entries = append(t.entries, ledgerEntry{"opening", o.Time, 0, o.Amount})
+	}
+	for _, d := range l.deposits {
+		t := wallet(d.Currency)
+		t.deposits++
+		t.add(&t.depositSum, d.Amount)
+		t.entries = append(t.entries, ledgerEntry{fmt.Sprintf("deposit %d", d.DepositId), d.Time, d.BalanceBefore, d.BalanceAfter})
+	}
+	rolledBack := map[uint64]bool{}
+	for _, tr := range l.transactions {
+		if tr.Type == "Rollback" {
+			rolledBack[tr.RefTransactionId] = true
+		}
+	}
+	for _, tr := range l.transactions {
+		t := wallet(tr.Currency)
+		switch {
+		case tr.Type == "Bet" && !rolledBack[tr.TransactionId]:
+			t.bets++
+			t.add(&t.betSum, tr.Amount)
+		case tr.Type == "Win":
+			t.wins++
+			t.add(&t.winSum, tr.Amount)
+		}
+		t.entries = append(t.entries, ledgerEntry{fmt.Sprintf("transaction %d", tr.TransactionId), tr.Time, tr.BalanceBefore, tr.BalanceAfter})
+	}
+	for _, w := range l.withdrawals {
+		t := wallet(w.Currency)
+		t.entries = append(t.entries, ledgerEntry{fmt.Sprintf("withdrawal %d", w.WithdrawalId), w.Time, w.BalanceBefore, w.BalanceAfter})
+		switch w.Status {
+		case "rejected":
+			t.entries = append(t.entries, ledgerEntry{fmt.Sprintf("release of withdrawal %d", w.WithdrawalId), w.UpdatedAt, w.ReleaseBalanceBefore, w.ReleaseBalanceAfter})
+		case "pending", "approved":
+			t.add(&t.held, w.Amount)
+			fallthrough
+		default:
+			t.withdrawals++
+			t.add(&t.withdrawSum, w.Amount)
+		}
+	}
+
+	var violations []InvariantViolation
+	report := func(currency, format string, args ...interface{}) {
+		violations = append(violations, InvariantViolation{UserId: l.user.Id, Currency: currency, Problem: fmt.Sprintf(format, args...)})
+	}
+	for currency := range totals {
+		if _, ok := l.user.Wallets[currency]; !ok {
+			report(currency, "ledger entries in a currency without a wallet")
+		}
+	}
+	for currency, w := range l.user.Wallets {
+		t := wallet(currency)
+		if t.outOfRange {
+			report(currency, "the sums of the ledger entries are out of range")
+			continue
+		}
+		if w.DepositCount != t.deposits || w.DepositSum != t.depositSum {
+			report(currency, "deposits: wallet %d/%v, ledger %d/%v", w.DepositCount, w.DepositSum, t.deposits, t.depositSum)
+		}
+		if w.BetCount != t.bets || w.BetSum != t.betSum {
+			report(currency, "bets: wallet %d/%v, ledger %d/%v", w.BetCount, w.BetSum, t.bets, t.betSum)
+		}
+		if w.WinCount != t.wins || w.WinSum != t.winSum {
+			report(currency, "wins: wallet %d/%v, ledger %d/%v", w.WinCount, w.WinSum, t.wins, t.winSum)
+		}
+		if w.WithdrawCount != t.withdrawals || w.WithdrawSum != t.withdrawSum {
+			report(currency, "withdrawals: wallet %d/%v, ledger %d/%v", w.WithdrawCount, w.WithdrawSum, t.withdrawals, t.withdrawSum)
+		}
+		if w.Reserved != t.held {
+			report(currency, "reserved: wallet %v, pending and approved withdrawals %v", w.Reserved, t.held)
+		}
+		if t.opening != nil && w.InitialBalance != t.opening.Amount {
+			report(currency, "initial balance: wallet %v, opening %v", w.InitialBalance, t.opening.Amount)
+		}
+
+		entries := chainLedger(t.entries)
+		if len(entries) == 0 {
+			continue
+		}
+		balance := entries[0].balanceBefore
+		initial := balance
+		if t.opening != nil {
+			initial = t.opening.Amount
+		}
+		if expected, err := expectedBalance(initial, t); err != nil {
+			report(currency, "the balance expected from the initial balance %v and the ledger is out of range", initial)
+		} else if expected != w.Balance {
+			report(currency, "balance %v, expected %v from the initial balance %v and the ledger", w.Balance, expected, initial)
+		}
+		for _, e := range entries {
+			if e.balanceBefore != balance {
+				report(currency, "%s starts with the balance %v instead of %v", e.what, e.balanceBefore, balance)
+			}
+			balance = e.balanceAfter
+		}
+		if balance != w.Balance {
+			report(currency, "the last ledger entry leaves the balance %v instead of %v", balance, w.Balance)
+		}
+	}
+	return violations
+}
+
+// expectedBalance returns initial + deposits - bets + wins - withdrawals
+func expectedBalance(initial Money, t *walletTotals) (Money, error) {
+	b, err := initial.Add(t.depositSum)
+	if err == nil {
+		b, err = b.Sub(t.betSum)
+	}
+	if err == nil {
+		b, err = b.Add(t.winSum)
+	}
+	if err == nil {
+		b, err = b.Sub(t.withdrawSum)
+	}
+	return b, err
+}
+
+// chainLedger orders the entries by time. The entries with the same time (which is stored with
+// millisecond precision in MongoDB) are ordered so that they chain, where possible.
+func chainLedger(entries []ledgerEntry) []ledgerEntry {
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].time.Before(entries[j].time) })
+	for i := 1; i < len(entries); i++ {
+		if entries[i].balanceBefore == entries[i-1].balanceAfter {
+			continue
+		}
+		for j := i + 1; j < len(entries) && entries[j].time.Equal(entries[i].time); j++ {
+			if entries[j].balanceBefore == entries[i-1].balanceAfter {
+				entries[i], entries[j] = entries[j], entries[i]
+				break
+			}
+		}
+	}
+	return entries
+}
+
+// CheckInvariants checks the in-memory state. Each user is checked with its lock held,
+// so the operations of the other users go on meanwhile.
+func CheckInvariants() *InvariantReport {
+	report := &InvariantReport{Source: "memory", Time: time.Now(), Violations: []InvariantViolation{}}
+
+	refsMutex.RLock()
+	ids := make([]uint64, 0, len(UserRefs))
+	for id := range UserRefs {
+		ids = append(ids, id)
+	}
+	refsMutex.RUnlock()
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		userLock(id).Lock()
+		user, _ := lookupUser(id)
+		var openings []*Opening
+		for currency := range user.Wallets {
+			if o, ok := lookupOpening(openingKey(id, currency)); ok {
+				openings = append(openings, o)
+			}
+		}
+		l := &userLedger{
+			user:         user,
+			openings:     openings,
+			deposits:     lookupUserDeposits(id),
+			transactions: lookupUserTransactions(id),
+			withdrawals:  lookupUserWithdrawals(id),
+		}
+		report.Violations = append(report.Violations, l.check()...)
+		userLock(id).Unlock()
+	}
+	report.Users = len(ids)
+	report.Duration = time.Since(report.Time)
+	return report
+}
+
+// CheckStoredInvariants checks the state stored in DB. It loads the whole state, so it takes
+// as long and as much memory as loading it at startup. The users with changes not synced yet
+// may be reported, as their balances can lag behind their ledger entries (see DbUpdate).
+func CheckStoredInvariants(ctx context.Context) (*InvariantReport, error) {
+	report := &InvariantReport{Source: "db", Time: time.Now(), Violations: []InvariantViolation{}}
+	ledgers := map[uint64]*userLedger{}
+	ledger := func(userId uint64) *userLedger {
+		l, ok := ledgers[userId]
+		if !ok {
+			l = new(userLedger)
+			ledgers[userId] = l
+		}
+		return l
+	}
+	err := DbStore.LoadAll(ctx, &StoreLoader{
+		User: func(u *User) error {
+			ledger(u.Id).user = u
+			return nil
+		},
+		Opening: func(o *Opening) error {
+			l := ledger(o.UserId)
+			l.openings = append(l.openings, o)
+			return nil
+		},
+		Deposit: func(d *Deposit) error {
+			l := ledger(d.UserId)
+			l.deposits = append(l.deposits, d)
+			return nil
+		},
+		Transaction: func(t *Transaction) error {
+			l := ledger(t.UserId)
+			l.transactions = append(l.transactions, t)
+			return nil
+		},
+		Withdrawal: func(w *Withdrawal) error {
+			l := ledger(w.UserId)
+			l.withdrawals = append(l.withdrawals, w)
+			return nil
+		},
+		Round:  func(r *Round) error { return nil },
+		APIKey: func(k *APIKey) error { return nil },
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint64, 0, len(ledgers))
+	for id := range ledgers {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		l := ledgers[id]
+		if l.user == nil {
+			report.Violations = append(report.Violations, InvariantViolation{UserId: id, Problem: "ledger entries of a user not in DB"})
+			continue
+		}
+		report.Violations = append(report.Violations, l.check()...)
+		report.Users++
+	}
+	report.Duration = time.Since(report.Time)
+	return report, nil
+}
+
+// recordInvariantReport publishes the result of a check in invariantMetrics
+func recordInvariantReport(r *InvariantReport) {
+	v := new(expvar.Int)
+	v.Set(int64(len(r.Violations)))
+	invariantMetrics.Set(r.Source+"_violations", v)
+	t := new(expvar.Int)
+	t.Set(r.Time.Unix())
+	invariantMetrics.Set(r.Source+"_last_check", t)
+	invariantMetrics.Add(r.Source+"_checks", 1)
+}
+
+// InvariantCheckLoop checks the in-memory state every period and logs the violations found
+func InvariantCheckLoop(period time.Duration) {
+	for {
+		time.Sleep(period)
+		r := CheckInvariants()
+		recordInvariantReport(r)
+		if len(r.Violations) == 0 {
+			continue
+		}
+		LogError("Invariant check failed", "violations", len(r.Violations), "users", r.Users)
+		for i, v := range r.Violations {
+			if i == invariantsMaxLogged {
+				LogError("Invariant check: more violations not logged", "count", len(r.Violations)-i)
+				break
+			}
+			LogError("Invariant violation", "userid", v.UserId, "currency", v.Currency, "problem", v.Problem)
+		}
+	}
+}
+
+const invariantsDbCheckMaxTime = 10 * time.Minute
+
+// CheckInvariantsHandler runs a check of the in-memory state, or of the state stored in DB with {"source": "db"}
+func CheckInvariantsHandler(c *gin.Context) {
+	var input CheckInvariantsInput
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var report *InvariantReport
+	if input.Source == "db" {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), invariantsDbCheckMaxTime)
+		defer cancel()
+		r, err := CheckStoredInvariants(ctx)
+		if err != nil {
+			LogRequest(c, LevelError, "Invariant check: failed to load the state from DB", "error", err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to load the state from DB: " + err.Error()})
+			return
+		}
+		report = r
+	} else {
+		report = CheckInvariants()
+	}
+	recordInvariantReport(report)
+	c.IndentedJSON(http.StatusOK, report)
+}
@@ -0,0 +1,144 @@
+package main
+
+import "sync"
+
+// Locking. The state of a user - the User object and the contents of its deposits, transactions, withdrawals
+// and rounds, including the per-user lists - is guarded by the lock of the user, see userLock. Handlers hold it
+// for their whole duration, so the operations of one user are serialized while different users proceed in parallel.
+// The Refs maps themselves are guarded by refsMutex, which is only held for looking up and inserting entries.
+// The sync queue (the NeedUpdate maps, the retry states and the dead letters) is guarded by queueMutex.
+// The order of locking is: the lock of one user (or of all of them, see lockAllUsers), refsMutex, queueMutex,
+// walSyncMutex, walMutex.
+
+const userLockShards = 256 // Users share locks: the lock of a user is the one of its shard
+
+var userLocks [userLockShards]sync.Mutex
+var refsMutex sync.RWMutex // For reading and updating all Refs maps and reservedIds
+var queueMutex sync.Mutex  // For reading and updating all NeedUpdate maps, syncRetries and DeadLetterRefs
+
+// userLock returns the lock of the user
+func userLock(userId uint64) *sync.Mutex {
+	return &userLocks[userId%userLockShards]
+}
+
+// lockAllUsers locks all the users in a fixed order, which stops all operations, e.g. to take a consistent snapshot
+func lockAllUsers() {
+	for i := range userLocks {
+		userLocks[i].Lock()
+	}
+}
+
+func unlockAllUsers() {
+	for i := range userLocks {
+		userLocks[i].Unlock()
+	}
+}
+
+var reservedIds = map[string]bool{} // IDs of the deposits, transactions and withdrawals being created, by syncKey
+
+// reserveId reserves the ID of a new deposit, transaction or withdrawal until releaseId, so that the requests
+// of different users cannot create two objects with the same ID. It fails if an object with the ID exists
+// or the ID is already reserved.
+func reserveId(kind string, id uint64) bool {
+	refsMutex.Lock()
+	defer refsMutex.Unlock()
+	var exists bool
+	switch kind {
+	case "deposit":
+		_, exists = DepositRefs[id]
+	case "transaction":
+		_, exists = TransactionRefs[id]
+	case "withdrawal":
+		_, exists = WithdrawalRefs[id]
+	}
+	key := syncKey(kind, id)
+	if exists || reservedIds[key] {
+		return false
+	}
+	reservedIds[key] = true
+	return true
+}
+
+func releaseId(kind string, id uint64) {
+	refsMutex.Lock()
+	defer refsMutex.Unlock()
+	delete(reservedIds, syncKey(kind, id))
+}
+
+// The lookup functions return the object with the ID from its Refs map. The object may only be read
+// with the lock of its user held, except for the ones that never change: openings, deposits and the copies
+// of transactions and withdrawals.
+
+func lookupUser(id uint64) (*User, bool) {
+	refsMutex.RLock()
+	defer refsMutex.RUnlock()
+	u, ok := UserRefs[id]
+	return u, ok
+}
+
+func lookupOpening(key string) (*Opening, bool) {
+	refsMutex.RLock()
+	defer refsMutex.RUnlock()
+	o, ok := OpeningRefs[key]
+	return o, ok
+}
+
+func lookupDeposit(id uint64) (*Deposit, bool) {
+	refsMutex.RLock()
+	defer refsMutex.RUnlock()
+	d, ok := DepositRefs[id]
+	return d, ok
+}
+
+// lookupTransaction returns a copy of the transaction: RolledBackBy of a bet changes with refsMutex held
+func lookupTransaction(id uint64) (*Transaction, bool) {
+	refsMutex.RLock()
+	defer refsMutex.RUnlock()
+	t, ok := TransactionRefs[id]
+	if !ok {
+		return nil, false
+	}
+	return t.clone(), true
+}
+
+// lookupWithdrawal returns a copy of the withdrawal, which can be read before taking the lock of its user
+func lookupWithdrawal(id uint64) (*Withdrawal, bool) {
+	refsMutex.RLock()
+	defer refsMutex.RUnlock()
+	w, ok := WithdrawalRefs[id]
+	if !ok {
+		return nil, false
+	}
+	return w.clone(), true
+}
+
+func lookupRound(key string) (*Round, bool) {
+	refsMutex.RLock()
+	defer refsMutex.RUnlock()
+	r, ok := RoundRefs[key]
+	return r, ok
+}
+
+func lookupUserDeposits(userId uint64) []*Deposit {
+	refsMutex.RLock()
+	defer refsMutex.RUnlock()
+	return UserDepositRefs[userId]
+}
+
+func lookupUserTransactions(userId uint64) []*Transaction {
+	refsMutex.RLock()
+	defer refsMutex.RUnlock()
+	return UserTransactionRefs[userId]
+}
+
+func lookupUserWithdrawals(userId uint64) []*Withdrawal {
+	refsMutex.RLock()
+	defer refsMutex.RUnlock()
+	return UserWithdrawalRefs[userId]
+}
+
+func lookupUserRounds(userId uint64) []*Round {
+	refsMutex.RLock()
+	defer refsMutex.RUnlock()
+	return UserRoundRefs[userId]
+}
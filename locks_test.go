@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+// benchmarkBets places bets of 1 in parallel, each goroutine on its own user if distinct, all on user 1 otherwise
+func benchmarkBets(b *testing.B, distinct bool) {
+	setupTestState(b)
+	router := NewRouter()
+	admin := newTestAPIKey(b, "admin", nil, false)
+	mustRequest(b, router, "/user/create", admin, `{"id":1,"currency":"EUR","balance":"1000000000"}`, http.StatusCreated)
+
+	var nextUserId, nextTransactionId uint64 = 1, 0
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		userId := uint64(1)
+		if distinct {
+			userId = atomic.AddUint64(&nextUserId, 1)
+			body := fmt.Sprintf(`{"id":%d,"currency":"EUR","balance":"1000000000"}`, userId)
+			if w := doRequest(router, http.MethodPost, "/user/create", admin, body); w.Code != http.StatusCreated {
+				b.Errorf("creating user %d: got %d %s", userId, w.Code, w.Body.String())
+				return
+			}
+		}
+		for pb.Next() {
+			id := atomic.AddUint64(&nextTransactionId, 1)
+			body := fmt.Sprintf(`{"transactionid":%d,"userid":%d,"type":"Bet","currency":"EUR","amount":"1"}`, id, userId)
+			if w := doRequest(router, http.MethodPost, "/transaction", admin, body); w.Code != http.StatusCreated {
+				b.Errorf("bet %d: got %d %s", id, w.Code, w.Body.String())
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkBetsDistinctUsers(b *testing.B) {
+	benchmarkBets(b, true)
+}
+
+func BenchmarkBetsSameUser(b *testing.B) {
+	benchmarkBets(b, false)
+}
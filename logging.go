@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The logs are written to stderr as JSON lines: {"time": ..., "level": ..., "msg": ..., <fields>}.
+// The fields are given to the log functions as key/value pairs, e.g.
+// LogWarn("DB sync failed", "userid", 12, "error", err). The logs of a request carry its "requestid".
+
+// Log levels
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+var logLevel = LevelInfo // Lower levels are not logged, set from the configuration
+var logMutex sync.Mutex  // For logOutput
+var logOutput io.Writer = os.Stderr
+
+const requestIdHeader = "X-Request-ID"
+const maxRequestIdLength = 128
+
+// ParseLogLevel returns the level with the name
+func ParseLogLevel(name string) (int, error) {
+	for level, n := range logLevelNames {
+		if n == name {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+// logValue returns the value to put in the JSON of a log line
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	}
+	return v
+}
+
+func logLine(level int, msg string, fields []interface{}) {
+	if level < logLevel {
+		return
+	}
+	var b bytes.Buffer
+	b.WriteString(`{"time":`)
+	t, _ := json.Marshal(time.Now().UTC().Format(time.RFC3339Nano))
+	b.Write(t)
+	b.WriteString(`,"level":"` + logLevelNames[level] + `","msg":`)
+	m, _ := json.Marshal(msg)
+	b.Write(m)
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		var value interface{} = "(missing)"
+		if i+1 < len(fields) {
+			value = logValue(fields[i+1])
+		}
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(value)
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(value))
+		}
+		b.WriteByte(',')
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteString("}\n")
+
+	logMutex.Lock()
+	logOutput.Write(b.Bytes())
+	logMutex.Unlock()
+}
+
+func LogDebug(msg string, fields ...interface{}) { logLine(LevelDebug, msg, fields) }
+func LogInfo(msg string, fields ...interface{})  { logLine(LevelInfo, msg, fields) }
+func LogWarn(msg string, fields ...interface{})  { logLine(LevelWarn, msg, fields) }
+func LogError(msg string, fields ...interface{}) { logLine(LevelError, msg, fields) }
+
+// LogFatal logs the error and exits
+func LogFatal(msg string, fields ...interface{}) {
+	logLine(LevelError, msg, fields)
+	os.Exit(1)
+}
+
+// LogRequest logs with the ID of the request
+func LogRequest(c *gin.Context, level int, msg string, fields ...interface{}) {
+	logLine(level, msg, append([]interface{}{"requestid", c.GetString("requestid")}, fields...))
+}
+
+// logFields returns the IDs of the objects of the entry as log fields
+func (e *walEntry) logFields() []interface{} {
+	var fields []interface{}
+	switch {
+	case e.User != nil:
+		fields = append(fields, "userid", e.User.Id)
+	case e.Opening != nil:
+		fields = append(fields, "userid", e.Opening.UserId)
+	case e.Deposit != nil:
+		fields = append(fields, "userid", e.Deposit.UserId)
+	case e.Transaction != nil:
+		fields = append(fields, "userid", e.Transaction.UserId)
+	case e.Withdrawal != nil:
+		fields = append(fields, "userid", e.Withdrawal.UserId)
+	case e.Round != nil:
+		fields = append(fields, "userid", e.Round.UserId)
+	}
+	if e.Opening != nil {
+		fields = append(fields, "currency", e.Opening.Currency)
+	}
+	if e.Deposit != nil {
+		fields = append(fields, "depositid", e.Deposit.DepositId)
+	}
+	if e.Transaction != nil {
+		fields = append(fields, "transactionid", e.Transaction.TransactionId)
+	}
+	if e.Withdrawal != nil {
+		fields = append(fields, "withdrawalid", e.Withdrawal.WithdrawalId)
+	}
+	if e.Round != nil {
+		fields = append(fields, "roundid", e.Round.RoundId)
+	}
+	return fields
+}
+
+// validRequestId tells whether an ID sent by the client can be used: printable ASCII of a sane length
+func validRequestId(id string) bool {
+	if id == "" || len(id) > maxRequestIdLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// RequestID is a middleware that gives each request an ID: the one in the X-Request-ID header if valid,
+// a new random one otherwise. The ID is sent back in the same header and is available as c.GetString("requestid").
+func RequestID(c *gin.Context) {
+	id := c.GetHeader(requestIdHeader)
+	if !validRequestId(id) {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			LogError("Failed to generate a request ID", "error", err)
+		}
+		id = hex.EncodeToString(b)
+	}
+	c.Set("requestid", id)
+	c.Header(requestIdHeader, id)
+	c.Next()
+}
+
+// AccessLog is a middleware that logs each request when it completes, at the error level if it failed with 5xx
+func AccessLog(c *gin.Context) {
+	started := time.Now()
+	c.Next()
+	status := c.Writer.Status()
+	level := LevelInfo
+	if status >= http.StatusInternalServerError {
+		level = LevelError
+	}
+	fields := []interface{}{
+		"method", c.Request.Method,
+		"path", c.Request.URL.Path,
+		"route", c.FullPath(),
+		"status", status,
+		"duration", time.Since(started),
+		"bytes", c.Writer.Size(),
+		"clientip", c.ClientIP(),
+	}
+	if key, ok := c.Get("apikey"); ok {
+		fields = append(fields, "apikeyid", key.(*APIKey).Id)
+	}
+	LogRequest(c, level, "Request", fields...)
+}
+
+// Recovery is a middleware that turns a panic in a handler into a 500 response and logs it with the stack
+var Recovery = gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, err interface{}) {
+	LogRequest(c, LevelError, "Panic", "error", fmt.Sprint(err), "stack", string(debug.Stack()))
+	c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+})
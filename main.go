@@ -2,67 +2,229 @@ package main
 
 import (
 	"context"
+	"expvar"
+	"flag"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-func StartServer() *http.Server {
-	router := gin.Default()
-	router.POST("/user/create", AddUser)
-	router.POST("/user/get", GetUser)
-	router.POST("/user/deposit", AddDeposit)
-	router.POST("/transaction", AddTransaction)
+// NewRouter returns the router with all the endpoints
+func NewRouter() *gin.Engine {
+	if os.Getenv(gin.EnvGinMode) == "" {
+		gin.SetMode(gin.ReleaseMode) // The debug mode prints unstructured lines
+	}
+	router := gin.New()
+	router.Use(RequestID, AccessLog, RequestMetrics, Recovery)
+	router.GET("/healthz", Liveness)
+	router.GET("/readyz", Readiness)
+	router.Use(RequireState, Authenticate) // Not for the routes above
+
+	client := router.Group("/", Authorize("client"))
+	client.POST("/user/create", AddUser)
+	client.POST("/user/get", GetUser)
+	client.POST("/user/wallet", AddWallet)
+	client.POST("/user/deposit", AddDeposit)
+	client.POST("/transaction", AddTransaction)
+	client.POST("/user/withdraw", AddWithdrawal)
+	client.POST("/user/rounds", GetUserRounds)
+	client.POST("/user/deposits", GetUserDeposits)
+	client.POST("/user/transactions", GetUserTransactions)
+	client.POST("/round/get", GetRound)
+	client.POST("/round/close", CloseRound)
+
+	admin := router.Group("/admin", Authorize("admin"))
+	admin.POST("/withdrawal/get", GetWithdrawal)
+	admin.POST("/withdrawal/status", SetWithdrawalStatus)
+	admin.POST("/apikey/create", CreateAPIKey)
+	admin.POST("/apikey/revoke", RevokeAPIKey)
+	admin.POST("/apikey/rotate", RotateAPIKey)
+	admin.POST("/apikey/list", ListAPIKeys)
+	admin.POST("/deadletter/list", ListDeadLetters)
+	admin.POST("/deadletter/redrive", RedriveDeadLetters)
+	admin.POST("/invariants/check", CheckInvariantsHandler)
+	admin.GET("/debug/vars", gin.WrapH(expvar.Handler()))
+	router.GET("/metrics", Authorize("admin"), Metrics)
+	return router
+}
+
+func StartServer(cfg *ServerConfig) *http.Server {
+	router := NewRouter()
+
 	srv := &http.Server{
-		Addr:    ":8080",
-		Handler: router,
+		Addr:         cfg.ListenAddr,
+		Handler:      router,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
 	}
 	go func() {
-		if err := srv.ListenAndServe(); err != nil {
-			fmt.Println("Http listener stopped: ", err)
+		var err error
+		if cfg.TLSCertFile != "" {
+			err = srv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err == http.ErrServerClosed {
+			LogInfo("HTTP listener stopped")
+		} else if err != nil {
+			LogError("HTTP listener stopped", "error", err)
 		}
 	}()
 	return srv
 }
 
 func main() {
-	dbUpdatePeriod := time.Second * 10
-	dbUpdateMaxSyncTime := time.Second * 5
-	chStopLoop := make(chan int) // Any data sent to this chan will stop sync with DB
+	migrate := flag.Bool("migrate", false, "Rewrite the documents stored by older versions in the current format and exit")
+	migrateCurrency := flag.String("migrate-currency", "EUR", "Currency of the single-currency documents stored by older versions")
+	genAPIKey := flag.String("gen-api-key", "", "Generate an API key with this label, print it with its API_KEYS_FILE entry and exit")
+	genAPIKeyRole := flag.String("gen-api-key-role", "admin", "Role of the key generated with -gen-api-key: admin or client")
+	configFile := flag.String("config", "", "YAML or JSON config file (env CONFIG_FILE)")
+	ConfigFlags(flag.CommandLine)
+	flag.Parse()
 
-	DbConnect()
-	go DbSyncLoop(chStopLoop, dbUpdatePeriod, dbUpdateMaxSyncTime)
+	if *genAPIKey != "" {
+		if err := PrintNewAPIKey(*genAPIKey, *genAPIKeyRole); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to generate an API key:", err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	srv := StartServer()
+	cfg, err := LoadConfig(*configFile, flag.CommandLine)
+	if err != nil {
+		LogFatal("Failed to load the configuration", "error", err)
+	}
+	logLevel, _ = ParseLogLevel(cfg.LogLevel)
+	LogInfo("Configuration", "config", cfg.Redacted())
 
-	quit := make(chan os.Signal, 100)
-	signal.Notify(quit, os.Interrupt)
+	DbConnect(&cfg.Storage)
+	if err := LoadCustomCurrencies(cfg.CustomCurrencies); err != nil {
+		LogFatal("Failed to load the custom currencies", "error", err)
+	}
+	if *migrate {
+		DbMigrate(*migrateCurrency)
+		return
+	}
+	if cfg.Sync.Durability == "sync" && !DbStore.CanCommit() {
+		LogFatal("DURABILITY=sync needs a storage backend with transactions (a MongoDB replica set)")
+	}
+	readyMaxSyncAge = cfg.Server.ReadyMaxSyncAge
+	readyMaxQueue = cfg.Server.ReadyMaxQueue
+	srv := StartServer(&cfg.Server) // Only /healthz and /readyz are served until SetStateLoaded
 
-	<-quit
-	fmt.Println("Shutting down the server...")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	DurabilityMode = cfg.Sync.Durability
+	syncCommitMaxTime = cfg.Sync.CommitTimeout
+	SyncCommitChunkSize = cfg.Storage.Mongo.BatchSize
+	SyncMaxAttempts = cfg.Sync.MaxAttempts
+	if cfg.Sync.WalDir != "none" && cfg.Storage.Backend != "memory" {
+		if err := WalOpen(cfg.Sync.WalDir); err != nil {
+			LogFatal("Failed to open the WAL", "error", err)
+		}
+	}
+	if cfg.Sync.DeadLetterFile != "none" {
+		if err := DeadLettersOpen(cfg.Sync.DeadLetterFile); err != nil {
+			LogFatal("Failed to load the dead letters", "error", err)
+		}
+	}
+	if err := DbLoadState(cfg.Sync.LoadTimeout); err != nil {
+		LogFatal("Failed to load state from DB", "error", err)
+	}
+	if cfg.APIKeysFile != "" {
+		if err := LoadAPIKeysFile(cfg.APIKeysFile); err != nil {
+			LogFatal("Failed to load API keys", "error", err)
+		}
+	}
+	syncCtx, stopSync := context.WithCancel(context.Background())
+	syncStopped := make(chan struct{})
+	go DbSyncLoop(syncCtx, syncStopped, cfg.Sync.Period, cfg.Sync.MaxTime)
+	if cfg.InvariantCheckPeriod > 0 {
+		go InvariantCheckLoop(cfg.InvariantCheckPeriod)
+	}
+	SetStateLoaded()
+
+	// Until now a signal kills the process: nothing has been acknowledged that is not in DB or in the WAL
+	quit := make(chan os.Signal, 2)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+
+	sig := <-quit
+	LogInfo("Shutting down the server", "signal", sig.String())
+	go func() {
+		sig := <-quit
+		LogError("Exiting without completing the shutdown", "signal", sig.String())
+		os.Exit(1)
+	}()
+	os.Exit(shutdown(cfg, srv, stopSync, syncStopped))
+}
+
+const dbCloseMaxTime = 5 * time.Second // Counted in the shutdown budget, see the README
+const shutdownMaxLoggedKeys = 100      // Keys of the objects left unwritten logged at shutdown
+
+// shutdown drains the requests in progress, stops the sync loop, writes everything to DB and disconnects.
+// It returns the exit code: 1 if anything is left unwritten to DB or the disconnection failed.
+func shutdown(cfg *Config, srv *http.Server, stopSync context.CancelFunc, syncStopped <-chan struct{}) int {
+	SetShuttingDown()
+	if cfg.Server.DrainDelay > 0 {
+		// The load balancer sees /readyz failing and stops sending requests, which are still served meanwhile
+		LogInfo("Draining", "delay", cfg.Server.DrainDelay)
+		time.Sleep(cfg.Server.DrainDelay)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
 	err := srv.Shutdown(ctx)
+	cancel()
 	if err != nil {
-		log.Fatal(err)
+		// Their operations are still applied and synced below: the handlers hold the locks of their users
+		LogError("The requests in progress did not complete in time, closing their connections", "error", err)
+		srv.Close()
 	}
 
-	fmt.Println("Stopping sync loop...")
-	chStopLoop <- 1
+	LogInfo("Stopping the sync loop")
+	stopSync()
+	<-syncStopped // A sync in progress completes first, within DB_SYNC_MAX_TIME
 
-	fmt.Println("Performing last sync...")
-	DbUpdate(dbUpdateMaxSyncTime)
+	LogInfo("Performing the last sync")
+	code := 0
+	unwritten, deadLetters := DbFinalSync(cfg.Sync.MaxTime, time.Now().Add(cfg.Sync.FinalTimeout))
+	if len(unwritten) > 0 {
+		code = 1
+		kept := "lost: the WAL is disabled"
+		if walEnabled {
+			kept = "kept in the WAL, replayed at the next start"
+		}
+		LogError("Objects not written to DB", "count", len(unwritten), "keys", firstKeys(unwritten), "kept", kept)
+	}
+	if len(deadLetters) > 0 {
+		code = 1
+		LogError("Dead letters not written to DB", "count", len(deadLetters), "keys", firstKeys(deadLetters),
+			"kept", "in the dead letters file, applied at the next start")
+	}
 
-	fmt.Println("Disconnecting from DB...")
-	ctx, ctxCancel := context.WithTimeout(context.Background(), time.Second)
-	DbClient.Disconnect(ctx)
-	ctxCancel()
-	DbCtxConnectCancel()
+	LogInfo("Disconnecting from DB")
+	ctx, cancel = context.WithTimeout(context.Background(), dbCloseMaxTime)
+	err = DbStore.Close(ctx)
+	cancel()
+	if err != nil {
+		code = 1
+		LogError("Failed to disconnect from DB", "error", err)
+	}
 
-	fmt.Println("SHUTDOWN COMPLETE")
+	if code != 0 {
+		LogError("Shutdown complete, not everything was persisted", "unwritten", len(unwritten), "deadletters", len(deadLetters))
+	} else {
+		LogInfo("Shutdown complete")
+	}
+	return code
+}
+
+// firstKeys returns the keys to log out of a possibly long list
+func firstKeys(keys []string) []string {
+	if len(keys) > shutdownMaxLoggedKeys {
+		return keys[:shutdownMaxLoggedKeys]
+	}
+	return keys
 }
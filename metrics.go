@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /metrics serves the metrics in the Prometheus text format (version 0.0.4). It needs an admin key:
+// Prometheus sends it with "authorization: {credentials: <key>}" in the scrape config.
+// The counters are kept here, the gauges are read from the in-memory state at each scrape.
+
+var requestDurationBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+var syncDurationBuckets = []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+var httpRequests = newCounterVec("http_requests_total", "HTTP requests by route, method and status.", "route", "method", "status")
+var httpRequestDuration = newHistogramVec("http_request_duration_seconds", "HTTP request latencies by route, method and status.",
+	requestDurationBuckets, "route", "method", "status")
+var walletOperations = newCounterVec("wallet_operations_total", "Deposits, bets, wins, rollbacks and withdrawals made.", "type", "currency")
+var walletOperationAmounts = newMoneyCounterVec("wallet_operation_amount_total", "Sum of the amounts of the operations made.", "type", "currency")
+var walletRejections = newCounterVec("wallet_rejections_total", "Requests rejected by reason.", "reason")
+var syncDuration = newHistogramVec("db_sync_duration_seconds", "Duration of the DB syncs (DbUpdate).", syncDurationBuckets)
+var syncFlushed = newCounterVec("db_sync_documents_flushed_total", "Documents written to DB by the syncs.")
+var syncFailed = newCounterVec("db_sync_documents_failed_total", "Documents the syncs failed to write to DB.")
+
+// Reasons of the rejections counted in walletRejections
+const (
+	rejectInsufficientBalance = "insufficient_balance"
+	rejectDuplicateId         = "duplicate_id"
+	rejectBadToken            = "bad_token"
+)
+
+func init() {
+	for _, reason := range []string{rejectInsufficientBalance, rejectDuplicateId, rejectBadToken} {
+		walletRejections.Add(0, reason) // Every reason has a series from the start
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelKey joins the values of the labels into a map key
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// formatLabels returns the labels as {name="value",...}, with the extra ones at the end
+func formatLabels(names []string, key string, extra ...string) string {
+	var values []string
+	if len(names) > 0 {
+		values = strings.Split(key, "\xff")
+	}
+	pairs := make([]string, 0, len(names)+len(extra)/2)
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+labelValueEscaper.Replace(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+labelValueEscaper.Replace(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func writeHeader(b *bytes.Buffer, name, help, kind string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// counterVec is a counter with a series for each combination of the values of its labels
+type counterVec struct {
+	name, help string
+	labels     []string
+	mutex      sync.Mutex
+	values     map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (v *counterVec) Add(n float64, labelValues ...string) {
+	v.mutex.Lock()
+	v.values[labelKey(labelValues)] += n
+	v.mutex.Unlock()
+}
+
+func (v *counterVec) Inc(labelValues ...string) {
+	v.Add(1, labelValues...)
+}
+
+func (v *counterVec) write(b *bytes.Buffer) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	writeHeader(b, v.name, v.help, "counter")
+	if len(v.labels) == 0 && len(v.values) == 0 {
+		fmt.Fprintf(b, "%s 0\n", v.name) // A counter without labels is always there
+		return
+	}
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys) // The series in a stable order
+	for _, k := range keys {
+		fmt.Fprintf(b, "%s%s %s\n", v.name, formatLabels(v.labels, k), formatFloat(v.values[k]))
+	}
+}
+
+// moneyCounterVec is a counter of amounts, summed exactly as Money
+type moneyCounterVec struct {
+	name, help string
+	labels     []string
+	mutex      sync.Mutex
+	values     map[string]Money
+}
+
+func newMoneyCounterVec(name, help string, labels ...string) *moneyCounterVec {
+	return &moneyCounterVec{name: name, help: help, labels: labels, values: map[string]Money{}}
+}
+
+func (v *moneyCounterVec) Add(m Money, labelValues ...string) {
+	v.mutex.Lock()
+	v.values[labelKey(labelValues)] += m
+	v.mutex.Unlock()
+}
+
+func (v *moneyCounterVec) write(b *bytes.Buffer) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	writeHeader(b, v.name, v.help, "counter")
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys) // The series in a stable order
+	for _, k := range keys {
+		fmt.Fprintf(b, "%s%s %s\n", v.name, formatLabels(v.labels, k), v.values[k].String())
+	}
+}
+
+// histogramVec is a histogram with a series for each combination of the values of its labels
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64 // Upper bounds, ascending, without +Inf
+	mutex      sync.Mutex
+	series     map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // Observations in each bucket, not cumulative; the last one is +Inf
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+}
+
+func (v *histogramVec) Observe(value float64, labelValues ...string) {
+	i := sort.SearchFloat64s(v.buckets, value) // The first bucket with an upper bound >= value
+	key := labelKey(labelValues)
+	v.mutex.Lock()
+	h, ok := v.series[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(v.buckets)+1)}
+		v.series[key] = h
+	}
+	h.counts[i]++
+	h.sum += value
+	h.count++
+	v.mutex.Unlock()
+}
+
+func (v *histogramVec) write(b *bytes.Buffer) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	writeHeader(b, v.name, v.help, "histogram")
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys) // The series in a stable order
+	for _, k := range keys {
+		h := v.series[k]
+		var cumulative uint64
+		for i, le := range v.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(b, "%s_bucket%s %d\n", v.name, formatLabels(v.labels, k, "le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", v.name, formatLabels(v.labels, k, "le", "+Inf"), h.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", v.name, formatLabels(v.labels, k), formatFloat(h.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", v.name, formatLabels(v.labels, k), h.count)
+	}
+}
+
+// RequestMetrics is a middleware that counts the requests and measures their latencies.
+// It is installed after RequestID and AccessLog but before Recovery and the API key checks,
+// so that it sees the panics and the requests rejected by the key checks too.
+func RequestMetrics(c *gin.Context) {
+	started := time.Now()
+	c.Next()
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched" // Unknown paths would make a series each
+	}
+	status := strconv.Itoa(c.Writer.Status())
+	httpRequests.Inc(route, c.Request.Method, status)
+	httpRequestDuration.Observe(time.Since(started).Seconds(), route, c.Request.Method, status)
+}
+
+// recordOperation counts an operation made on a wallet
+func recordOperation(kind, currency string, amount Money) {
+	walletOperations.Inc(kind, currency)
+	walletOperationAmounts.Add(amount, kind, currency)
+}
+
+// recordRejection counts a request rejected for one of the reasons above
+func recordRejection(reason string) {
+	walletRejections.Inc(reason)
+}
+
+// recordSync counts the result of a DbUpdate
+func recordSync(r *SyncReport) {
+	syncDuration.Observe(r.Duration.Seconds())
+	syncFlushed.Add(float64(r.Flushed))
+	syncFailed.Add(float64(r.Failed))
+}
+
+// writeStateGauges writes the gauges read from the in-memory state
+func writeStateGauges(b *bytes.Buffer) {
+	refsMutex.RLock()
+	users := len(UserRefs)
+	refsMutex.RUnlock()
+
+	queueMutex.Lock()
+	queues := map[string]int{
+		"user":        len(UserRefsNeedUpdate),
+		"opening":     len(OpeningRefsNeedUpdate),
+		"deposit":     len(DepositRefsNeedUpdate),
+		"transaction": len(TransactionRefsNeedUpdate),
+		"withdrawal":  len(WithdrawalRefsNeedUpdate),
+		"round":       len(RoundRefsNeedUpdate),
+	}
+	retries := len(syncRetries)
+	deadLetters := len(DeadLetterRefs)
+	queueMutex.Unlock()
+
+	writeHeader(b, "users_in_memory", "Users held in memory.", "gauge")
+	fmt.Fprintf(b, "users_in_memory %d\n", users)
+	writeHeader(b, "sync_queue_size", "Objects waiting to be written to DB, by NeedUpdate queue.", "gauge")
+	for _, kind := range []string{"user", "opening", "deposit", "transaction", "withdrawal", "round"} {
+		fmt.Fprintf(b, "sync_queue_size{queue=%q} %d\n", kind, queues[kind])
+	}
+	writeHeader(b, "sync_retries_pending", "Objects whose last write to DB failed and waits for a retry.", "gauge")
+	fmt.Fprintf(b, "sync_retries_pending %d\n", retries)
+	writeHeader(b, "sync_dead_letters", "Objects that failed to be written to DB too many times.", "gauge")
+	fmt.Fprintf(b, "sync_dead_letters %d\n", deadLetters)
+}
+
+// writeInvariantGauges writes the result of the last invariant check of each source, once one has run
+func writeInvariantGauges(b *bytes.Buffer) {
+	gauge := func(source, suffix string) (int64, bool) {
+		v, ok := invariantMetrics.Get(source + suffix).(*expvar.Int)
+		if !ok {
+			return 0, false
+		}
+		return v.Value(), true
+	}
+	writeHeader(b, "invariant_violations", "Violations found by the last invariant check, by source (memory or db).", "gauge")
+	for _, source := range []string{"db", "memory"} {
+		if n, ok := gauge(source, "_violations"); ok {
+			fmt.Fprintf(b, "invariant_violations{source=%q} %d\n", source, n)
+		}
+	}
+	writeHeader(b, "invariant_last_check_timestamp_seconds", "Unix time of the last invariant check, by source (memory or db).", "gauge")
+	for _, source := range []string{"db", "memory"} {
+		if t, ok := gauge(source, "_last_check"); ok {
+			fmt.Fprintf(b, "invariant_last_check_timestamp_seconds{source=%q} %d\n", source, t)
+		}
+	}
+}
+
+func Metrics(c *gin.Context) {
+	var b bytes.Buffer
+	httpRequests.write(&b)
+	httpRequestDuration.write(&b)
+	walletOperations.write(&b)
+	walletOperationAmounts.write(&b)
+	walletRejections.write(&b)
+	syncDuration.write(&b)
+	syncFlushed.write(&b)
+	syncFailed.write(&b)
+	writeStateGauges(&b)
+	writeInvariantGauges(&b)
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", b.Bytes())
+}
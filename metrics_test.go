@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetricsInvariantGauges(t *testing.T) {
+	setupTestState(t)
+	router := NewRouter()
+	admin := newTestAPIKey(t, "admin", nil, false)
+	mustRequest(t, router, "/user/create", admin, `{"id":1,"currency":"EUR","balance":"100"}`, http.StatusCreated)
+
+	r := CheckInvariants()
+	r.Violations = append(r.Violations, InvariantViolation{UserId: 1, Currency: "EUR", Problem: "test"})
+	recordInvariantReport(r)
+
+	w := doRequest(router, http.MethodGet, "/metrics", admin, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /metrics: got %d", w.Code)
+	}
+	for _, want := range []string{
+		"# TYPE invariant_violations gauge\n",
+		"invariant_violations{source=\"memory\"} 1\n",
+		"# TYPE invariant_last_check_timestamp_seconds gauge\n",
+		fmt.Sprintf("invariant_last_check_timestamp_seconds{source=\"memory\"} %d\n", r.Time.Unix()),
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("metrics without %q", want)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// Money is an exact monetary amount: a fixed-point decimal with MoneyDecimals fractional digits,
+// stored as an integer number of 10^-MoneyDecimals units.
+//
+// Precision: 8 fractional digits cover all fiat currencies (EUR, USD: 2 digits, some currencies: 0 or 3)
+// and the smallest units of the usual crypto currencies (BTC: 8 digits; ETH and tokens with more digits
+// are truncated to 8). The precision of each currency is in CurrencyDecimals, amounts with more
+// fractional digits are rejected. The largest representable amount is about 92 billion units.
+//
+// In JSON a Money is a plain decimal number (strings such as "10.25" are accepted as input too),
+// in BSON it is a Decimal128. Documents written by older versions with double fields are still
+// decoded (rounded to MoneyDecimals digits), see Migrator for rewriting them.
+type Money int64
+
+const MoneyDecimals = 8
+const moneyScale = 100000000 // 10^MoneyDecimals
+
+var errMoneyFormat = errors.New("invalid amount format")
+var errMoneyPrecision = fmt.Errorf("amount has more than %d fractional digits", MoneyDecimals)
+var errMoneyRange = errors.New("amount is out of range")
+
+// ParseMoney parses a decimal string such as "-12.345"
+func ParseMoney(s string) (Money, error) {
+	neg := false
+	switch {
+	case strings.HasPrefix(s, "-"):
+		neg = true
+		s = s[1:]
+	case strings.HasPrefix(s, "+"):
+		s = s[1:]
+	}
+	intPart, fracPart := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intPart, fracPart = s[:i], s[i+1:]
+	}
+	if intPart == "" && fracPart == "" || !isDigits(intPart) || !isDigits(fracPart) {
+		return 0, errMoneyFormat
+	}
+	fracPart = strings.TrimRight(fracPart, "0")
+	if len(fracPart) > MoneyDecimals {
+		return 0, errMoneyPrecision
+	}
+	fracPart += strings.Repeat("0", MoneyDecimals-len(fracPart))
+
+	var units uint64
+	if intPart != "" {
+		u, err := strconv.ParseUint(intPart, 10, 64)
+		if err != nil || u > math.MaxInt64/moneyScale {
+			return 0, errMoneyRange
+		}
+		units = u * moneyScale
+	}
+	frac, _ := strconv.ParseUint(fracPart, 10, 64)
+	units += frac
+	if units > math.MaxInt64 {
+		return 0, errMoneyRange
+	}
+	if neg {
+		return -Money(units), nil
+	}
+	return Money(units), nil
+}
+
+// Add returns m + n, or errMoneyRange if the sum is out of the range of Money
+func (m Money) Add(n Money) (Money, error) {
+	s := m + n
+	if (s > m) != (n > 0) {
+		return 0, errMoneyRange
+	}
+	return s, nil
+}
+
+// Sub returns m - n, or errMoneyRange if the difference is out of the range of Money
+func (m Money) Sub(n Money) (Money, error) {
+	d := m - n
+	if (d < m) != (n > 0) {
+		return 0, errMoneyRange
+	}
+	return d, nil
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// String formats m as a decimal without trailing zeros, e.g. "107.5"
+func (m Money) String() string {
+	u := uint64(m)
+	sign := ""
+	if m < 0 {
+		sign = "-"
+		u = uint64(-m)
+	}
+	s := sign + strconv.FormatUint(u/moneyScale, 10)
+	if frac := u % moneyScale; frac != 0 {
+		f := fmt.Sprintf("%0*d", MoneyDecimals, frac)
+		s += "." + strings.TrimRight(f, "0")
+	}
+	return s
+}
+
+// Decimals returns the number of significant fractional digits of m
+func (m Money) Decimals() int {
+	frac := int64(m) % moneyScale
+	if frac == 0 {
+		return 0
+	}
+	d := MoneyDecimals
+	for frac%10 == 0 {
+		frac /= 10
+		d--
+	}
+	return d
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *Money) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if s == "null" {
+		return nil
+	}
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+	}
+	v, err := ParseMoney(s)
+	if err != nil {
+		return fmt.Errorf("%s: %w", string(b), err)
+	}
+	*m = v
+	return nil
+}
+
+func (m Money) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	d, ok := primitive.ParseDecimal128FromBigInt(big.NewInt(int64(m)), -MoneyDecimals)
+	if !ok {
+		return 0, nil, errMoneyRange
+	}
+	return bsontype.Decimal128, bsoncore.AppendDecimal128(nil, d), nil
+}
+
+func (m *Money) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	v := bsoncore.Value{Type: t, Data: data}
+	switch t {
+	case bsontype.Decimal128:
+		return m.setDecimal128(v.Decimal128())
+	case bsontype.Double:
+		// Written by older versions: round to MoneyDecimals digits
+		f := v.Double()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return errMoneyRange
+		}
+		parsed, err := ParseMoney(strconv.FormatFloat(f, 'f', MoneyDecimals, 64))
+		if err != nil {
+			return err
+		}
+		*m = parsed
+	case bsontype.Int32:
+		*m = Money(v.Int32()) * moneyScale
+	case bsontype.Int64:
+		i := v.Int64()
+		if i > math.MaxInt64/moneyScale || i < math.MinInt64/moneyScale {
+			return errMoneyRange
+		}
+		*m = Money(i) * moneyScale
+	case bsontype.Null:
+		*m = 0
+	default:
+		return fmt.Errorf("cannot decode %v into Money", t)
+	}
+	return nil
+}
+
+func (m *Money) setDecimal128(d primitive.Decimal128) error {
+	bi, exp, err := d.BigInt()
+	if err != nil {
+		return err
+	}
+	ten := big.NewInt(10)
+	for ; exp > -MoneyDecimals; exp-- {
+		bi.Mul(bi, ten)
+	}
+	rem := new(big.Int)
+	for ; exp < -MoneyDecimals; exp++ {
+		bi.QuoRem(bi, ten, rem)
+		if rem.Sign() != 0 {
+			return errMoneyPrecision
+		}
+	}
+	if !bi.IsInt64() {
+		return errMoneyRange
+	}
+	*m = Money(bi.Int64())
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseMoney(t *testing.T) {
+	cases := []struct {
+		in   string
+		want Money
+		err  error
+	}{
+		{"0", 0, nil},
+		{"10", 10 * moneyScale, nil},
+		{"10.25", 1025000000, nil},
+		{"+10.25", 1025000000, nil},
+		{"-12.345", -1234500000, nil},
+		{".5", 50000000, nil},
+		{"5.", 5 * moneyScale, nil},
+		{"0.00000001", 1, nil},
+		{"1.100000000", 110000000, nil}, // Trailing zeros beyond the precision are fine
+		{"92233720368.54775807", math.MaxInt64, nil},
+		{"-92233720368.54775807", -math.MaxInt64, nil},
+		{"0.000000001", 0, errMoneyPrecision},
+		{"92233720368.54775808", 0, errMoneyRange},
+		{"92233720369", 0, errMoneyRange},
+		{"99999999999999999999", 0, errMoneyRange},
+		{"", 0, errMoneyFormat},
+		{".", 0, errMoneyFormat},
+		{"-", 0, errMoneyFormat},
+		{"1e3", 0, errMoneyFormat},
+		{"1.2.3", 0, errMoneyFormat},
+		{" 1", 0, errMoneyFormat},
+		{"--1", 0, errMoneyFormat},
+	}
+	for _, c := range cases {
+		got, err := ParseMoney(c.in)
+		if got != c.want || err != c.err {
+			t.Errorf("ParseMoney(%q) = %d, %v; want %d, %v", c.in, got, err, c.want, c.err)
+		}
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	cases := map[Money]string{
+		0:                 "0",
+		1:                 "0.00000001",
+		-1:                "-0.00000001",
+		10750000000:       "107.5",
+		-1234500000:       "-12.345",
+		math.MaxInt64:     "92233720368.54775807",
+		-math.MaxInt64:    "-92233720368.54775807",
+		100 * moneyScale:  "100",
+		-100 * moneyScale: "-100",
+	}
+	for m, want := range cases {
+		if got := m.String(); got != want {
+			t.Errorf("Money(%d).String() = %q, want %q", int64(m), got, want)
+		}
+	}
+}
+
+func TestMoneyAddSub(t *testing.T) {
+	cases := []struct {
+		m, n      Money
+		sum, diff Money
+		sumErr    error
+		diffErr   error
+	}{
+		{10, 3, 13, 7, nil, nil},
+		{-10, 3, -7, -13, nil, nil},
+		{math.MaxInt64, 0, math.MaxInt64, math.MaxInt64, nil, nil},
+		{math.MaxInt64, 1, 0, math.MaxInt64 - 1, errMoneyRange, nil},
+		{math.MaxInt64, -1, math.MaxInt64 - 1, 0, nil, errMoneyRange},
+		{math.MinInt64, -1, 0, math.MinInt64 + 1, errMoneyRange, nil},
+		{math.MinInt64, 1, math.MinInt64 + 1, 0, nil, errMoneyRange},
+		{0, math.MinInt64, math.MinInt64, 0, nil, errMoneyRange},
+		{-1, math.MinInt64, 0, math.MaxInt64, errMoneyRange, nil},
+	}
+	for _, c := range cases {
+		if got, err := c.m.Add(c.n); err != c.sumErr || err == nil && got != c.sum {
+			t.Errorf("%d + %d = %d, %v; want %d, %v", int64(c.m), int64(c.n), int64(got), err, int64(c.sum), c.sumErr)
+		}
+		if got, err := c.m.Sub(c.n); err != c.diffErr || err == nil && got != c.diff {
+			t.Errorf("%d - %d = %d, %v; want %d, %v", int64(c.m), int64(c.n), int64(got), err, int64(c.diff), c.diffErr)
+		}
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	for _, m := range []Money{0, 1, -1, 1025000000, math.MaxInt64, -math.MaxInt64} {
+		b, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Money
+		if err := json.Unmarshal(b, &got); err != nil || got != m {
+			t.Errorf("%s decoded as %d, %v; want %d", b, int64(got), err, int64(m))
+		}
+	}
+
+	var v struct{ Amount Money }
+	if err := json.Unmarshal([]byte(`{"Amount":"10.25"}`), &v); err != nil || v.Amount != 1025000000 {
+		t.Errorf("string amount decoded as %d, %v", int64(v.Amount), err)
+	}
+	for _, in := range []string{`{"Amount":"abc"}`, `{"Amount":1e3}`, `{"Amount":0.000000001}`, `{"Amount":92233720369}`} {
+		if err := json.Unmarshal([]byte(in), &v); err == nil {
+			t.Errorf("%s decoded without an error", in)
+		}
+	}
+}
+
+func TestMoneyBSON(t *testing.T) {
+	type doc struct{ Amount Money }
+	for _, m := range []Money{0, 1, -1, 1025000000, math.MaxInt64, -math.MaxInt64} {
+		b, err := bson.Marshal(doc{m})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var raw bson.M
+		if err := bson.Unmarshal(b, &raw); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := raw["amount"].(primitive.Decimal128); !ok {
+			t.Errorf("%d stored as %T, want a Decimal128", int64(m), raw["amount"])
+		}
+		var got doc
+		if err := bson.Unmarshal(b, &got); err != nil || got.Amount != m {
+			t.Errorf("%d decoded as %d, %v", int64(m), int64(got.Amount), err)
+		}
+	}
+}
+
+// The documents written by older versions, and the decimals written by other tools
+func TestMoneyBSONMigration(t *testing.T) {
+	decimal := func(s string) primitive.Decimal128 {
+		d, err := primitive.ParseDecimal128(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	cases := []struct {
+		name  string
+		value interface{}
+		want  Money
+		err   error
+	}{
+		{"double", 10.25, 1025000000, nil},
+		{"double rounded", 0.1 + 0.2, 30000000, nil},
+		{"negative double", -12.345, -1234500000, nil},
+		{"double out of range", 1e12, 0, errMoneyRange},
+		{"NaN", math.NaN(), 0, errMoneyRange},
+		{"infinity", math.Inf(1), 0, errMoneyRange},
+		{"int32", int32(7), 7 * moneyScale, nil},
+		{"int64", int64(-7), -7 * moneyScale, nil},
+		{"int64 out of range", int64(math.MaxInt64 / 10), 0, errMoneyRange},
+		{"null", nil, 0, nil},
+		{"decimal with fewer digits", decimal("10.25"), 1025000000, nil},
+		{"decimal with an exponent", decimal("1E+2"), 100 * moneyScale, nil},
+		{"decimal with trailing zeros", decimal("1.1000000000"), 110000000, nil},
+		{"decimal too precise", decimal("0.000000001"), 0, errMoneyPrecision},
+		{"decimal out of range", decimal("92233720368.54775808"), 0, errMoneyRange},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b, err := bson.Marshal(bson.M{"amount": c.value})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got struct{ Amount Money }
+			err = bson.Unmarshal(b, &got)
+			if !errors.Is(err, c.err) || got.Amount != c.want {
+				t.Errorf("got %d, %v; want %d, %v", int64(got.Amount), err, int64(c.want), c.err)
+			}
+		})
+	}
+}
+
+func TestDepositOverflowRejected(t *testing.T) {
+	setupTestState(t)
+	router := NewRouter()
+	admin := newTestAPIKey(t, "admin", nil, false)
+	mustRequest(t, router, "/user/create", admin, `{"id":1,"currency":"EUR","balance":"0"}`, http.StatusCreated)
+	mustRequest(t, router, "/user/deposit", admin, `{"depositid":1,"userid":1,"currency":"EUR","amount":"92233720368.54"}`, http.StatusCreated)
+
+	w := doRequest(router, http.MethodPost, "/user/deposit", admin, `{"depositid":2,"userid":1,"currency":"EUR","amount":"92233720368.54"}`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "out of range") {
+		t.Errorf("second deposit: got %d %s, want 400 out of range", w.Code, w.Body.String())
+	}
+	mustRequest(t, router, "/transaction", admin, `{"transactionid":1,"userid":1,"type":"Bet","currency":"EUR","amount":"1"}`, http.StatusCreated)
+	w = doRequest(router, http.MethodPost, "/transaction", admin, `{"transactionid":2,"userid":1,"type":"Win","currency":"EUR","amount":"2"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("win over the range: got %d %s, want 400", w.Code, w.Body.String())
+	}
+
+	user, _ := lookupUser(1)
+	if b := user.Wallets["EUR"].Balance.String(); b != "92233720367.54" {
+		t.Errorf("balance %s, want 92233720367.54", b)
+	}
+	if _, ok := lookupDeposit(2); ok {
+		t.Error("the rejected deposit is stored")
+	}
+	queueMutex.Lock()
+	_, queued := DepositRefsNeedUpdate[2]
+	queueMutex.Unlock()
+	if queued {
+		t.Error("the rejected deposit is queued for sync")
+	}
+	if r := CheckInvariants(); len(r.Violations) != 0 {
+		t.Errorf("invariant violations: %+v", r.Violations)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxRoundIdLength = 128
+
+// roundKey is the key of a round in RoundRefs and in DB: round IDs are only unique per user
+func roundKey(userId uint64, roundId string) string {
+	return strconv.FormatUint(userId, 10) + ":" + roundId
+}
+
+// clone returns a deep copy of the round
+func (r *Round) clone() *Round {
+	c := *r
+	c.TransactionIds = append([]uint64(nil), r.TransactionIds...)
+	return &c
+}
+
+// roundWith returns a copy of the round of the transaction with the transaction added to it.
+// If the transaction opens the round, the copy is a new round.
+func roundWith(t *Transaction) *Round {
+	key := roundKey(t.UserId, t.RoundId)
+	var round *Round
+	if existing, isInRoundRefs := lookupRound(key); isInRoundRefs {
+		round = existing.clone()
+	} else {
+		round = new(Round)
+		round.Key = key
+		round.RoundId = t.RoundId
+		round.UserId = t.UserId
+		round.Currency = t.Currency
+		round.Status = "open"
+		round.OpenedAt = t.Time
+	}
+
+	switch t.Type {
+	case "Bet":
+		round.BetSum += t.Amount
+	case "Win":
+		round.WinSum += t.Amount
+	case "Rollback":
+		round.BetSum -= t.Amount
+	}
+	round.TransactionIds = append(round.TransactionIds, t.TransactionId)
+	return round
+}
+
+func GetRound(c *gin.Context) {
+	var input RoundInput
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userLock(input.UserId).Lock()
+	defer userLock(input.UserId).Unlock()
+
+	round, isInRoundRefs := lookupRound(roundKey(input.UserId, input.RoundId))
+	if !isInRoundRefs {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Round not found"})
+		return
+	}
+
+	transactions := make([]*Transaction, len(round.TransactionIds))
+	for i, id := range round.TransactionIds {
+		transactions[i], _ = lookupTransaction(id)
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"round":        round,
+		"transactions": transactions,
+		"net":          round.WinSum - round.BetSum,
+	})
+}
+
+func CloseRound(c *gin.Context) {
+	var input RoundInput
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userLock(input.UserId).Lock()
+	defer userLock(input.UserId).Unlock()
+
+	existing, isInRoundRefs := lookupRound(roundKey(input.UserId, input.RoundId))
+	if !isInRoundRefs {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Round not found"})
+		return
+	}
+
+	round := existing.clone()
+	if round.Status == "closed" {
+		c.JSON(http.StatusConflict, gin.H{"error": "The round is already closed"})
+		return
+	}
+
+	now := time.Now()
+	round.Status = "closed"
+	round.ClosedAt = &now
+	if !commitOperation(c, &walEntry{Round: walRound(round)}) {
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, round)
+}
+
+func GetUserRounds(c *gin.Context) {
+	var input GetUserRoundsInput
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userLock(input.UserId).Lock()
+	defer userLock(input.UserId).Unlock()
+
+	_, isInUserRefs := lookupUser(input.UserId)
+	if !isInUserRefs {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	rounds := []*Round{}
+	for _, r := range lookupUserRounds(input.UserId) {
+		if input.Status == "" || r.Status == input.Status {
+			rounds = append(rounds, r)
+		}
+	}
+	c.IndentedJSON(http.StatusOK, rounds)
+}
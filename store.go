@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Store is a persistent storage backend for users, openings, deposits, transactions, withdrawals, rounds and API keys.
+// Users, withdrawals, rounds and API keys are mutable and are saved (upserted) as a whole,
+// openings, deposits and transactions are append-only.
+type Store interface {
+	SaveUsers(ctx context.Context, users []*User) error
+	SaveWithdrawals(ctx context.Context, withdrawals []*Withdrawal) error
+	SaveRounds(ctx context.Context, rounds []*Round) error
+	SaveAPIKeys(ctx context.Context, keys []*APIKey) error
+	AppendOpenings(ctx context.Context, openings []*Opening) error
+	AppendDeposits(ctx context.Context, deposits []*Deposit) error
+	AppendTransactions(ctx context.Context, transactions []*Transaction) error
+	CanCommit() bool                                   // Whether Commit is supported
+	Commit(ctx context.Context, b *StoreBatch) error   // Writes all the objects of the batch or none of them
+	LoadAll(ctx context.Context, l *StoreLoader) error // Streams all stored objects into l
+	Ping(ctx context.Context) error                    // Health check
+	Close(ctx context.Context) error
+}
+
+// StoreBatch is a set of objects written together by Store.Commit
+type StoreBatch struct {
+	Users        []*User
+	Openings     []*Opening
+	Deposits     []*Deposit
+	Transactions []*Transaction
+	Withdrawals  []*Withdrawal
+	Rounds       []*Round
+}
+
+// StoreLoader receives the objects streamed by Store.LoadAll.
+// Users, withdrawals, rounds and API keys are passed in no particular order, openings, deposits and transactions in the order they were appended
+// (per kind; kinds may be interleaved).
+// Loading stops at the first error returned by a callback.
+type StoreLoader struct {
+	User        func(u *User) error
+	Opening     func(o *Opening) error
+	Deposit     func(d *Deposit) error
+	Transaction func(t *Transaction) error
+	Withdrawal  func(w *Withdrawal) error
+	Round       func(r *Round) error
+	APIKey      func(k *APIKey) error
+}
+
+// Migrator is implemented by stores that may hold documents written by older versions:
+// monetary fields stored as floating point numbers and single-currency users, deposits and transactions.
+// Migrate rewrites them in the current format, putting the single-currency data into the
+// defaultCurrency wallets, and returns the number of rewritten documents.
+type Migrator interface {
+	Migrate(ctx context.Context, defaultCurrency string) (int, error)
+}
+
+// StoreErrors collects the errors of individual documents in a batch write, as *StoreItemError.
+// Any other error returned by a batch write means that none of its documents were written.
+type StoreErrors []error
+
+// StoreItemError is the error of the document at Index in a batch write
+type StoreItemError struct {
+	Index int
+	Err   error
+}
+
+func (e *StoreItemError) Error() string { return e.Err.Error() }
+func (e *StoreItemError) Unwrap() error { return e.Err }
+
+func (e StoreErrors) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "; ")
+}
+
+func (e StoreErrors) orNil() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// NewStore creates the storage backend selected by cfg.Backend: "mongo", "memory" or "file"
+func NewStore(ctx context.Context, cfg *StorageConfig) (Store, error) {
+	switch cfg.Backend {
+	case "mongo":
+		return NewMongoStore(ctx, cfg.Mongo)
+	case "memory":
+		return NewMemoryStore(), nil
+	case "file":
+		return NewFileStore(cfg.File)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
+	}
+}
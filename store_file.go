@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// FileStore keeps everything in a local append-only file of JSON records, one per line.
+// A user, withdrawal or round record supersedes all previous records of the same object
+// (for users: of the same or an older version).
+type FileStore struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// fileRecord is a single line of the FileStore file. Exactly one of the fields is set.
+type fileRecord struct {
+	User        *User        `json:"user,omitempty"`
+	Opening     *Opening     `json:"opening,omitempty"`
+	Deposit     *Deposit     `json:"deposit,omitempty"`
+	Transaction *Transaction `json:"transaction,omitempty"`
+	Withdrawal  *Withdrawal  `json:"withdrawal,omitempty"`
+	Round       *fileRound   `json:"round,omitempty"`
+	APIKey      *fileAPIKey  `json:"apikey,omitempty"`
+	Batch       []fileRecord `json:"batch,omitempty"` // Records written by Commit
+}
+
+// fileRound is a Round with its key, which is not a part of the JSON representation of Round
+type fileRound struct {
+	Key string `json:"key"`
+	*Round
+}
+
+// fileAPIKey is an APIKey with its hash, which is not a part of the JSON representation of APIKey
+type fileAPIKey struct {
+	Hash string `json:"hash"`
+	*APIKey
+}
+
+func NewFileStore(path string) (*FileStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := truncateTornRecord(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &FileStore{file: f}, nil
+}
+
+// truncateTornRecord cuts off the end of the file after the last newline:
+// a record whose write was interrupted by a crash
+func truncateTornRecord(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	buf := make([]byte, 4096)
+	end := size
+	for end > 0 {
+		n := int64(len(buf))
+		if n > end {
+			n = end
+		}
+		if _, err := f.ReadAt(buf[:n], end-n); err != nil {
+			return err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			end = end - n + int64(i) + 1
+			break
+		}
+		end -= n
+	}
+	if end == size {
+		return nil
+	}
+	LogWarn("Cutting off a torn record", "file", f.Name(), "bytes", size-end)
+	return f.Truncate(end)
+}
+
+// append writes the records and syncs the file to disk
+func (s *FileStore) append(records []fileRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	w := bufio.NewWriter(s.file)
+	enc := json.NewEncoder(w) // Encode terminates every record with a newline
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *FileStore) SaveUsers(ctx context.Context, users []*User) error {
+	records := make([]fileRecord, len(users))
+	for i, u := range users {
+		records[i].User = u
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.append(records)
+}
+
+func (s *FileStore) SaveWithdrawals(ctx context.Context, withdrawals []*Withdrawal) error {
+	records := make([]fileRecord, len(withdrawals))
+	for i, w := range withdrawals {
+		records[i].Withdrawal = w
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.append(records)
+}
+
+func (s *FileStore) SaveRounds(ctx context.Context, rounds []*Round) error {
+	records := make([]fileRecord, len(rounds))
+	for i, r := range rounds {
+		records[i].Round = &fileRound{Key: r.Key, Round: r}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.append(records)
+}
+
+func (s *FileStore) SaveAPIKeys(ctx context.Context, keys []*APIKey) error {
+	records := make([]fileRecord, len(keys))
+	for i, k := range keys {
+		records[i].APIKey = &fileAPIKey{Hash: k.Hash, APIKey: k}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.append(records)
+}
+
+func (s *FileStore) AppendOpenings(ctx context.Context, openings []*Opening) error {
+	records := make([]fileRecord, len(openings))
+	for i, o := range openings {
+		records[i].Opening = o
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.append(records)
+}
+
+func (s *FileStore) AppendDeposits(ctx context.Context, deposits []*Deposit) error {
+	records := make([]fileRecord, len(deposits))
+	for i, d := range deposits {
+		records[i].Deposit = d
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.append(records)
+}
+
+func (s *FileStore) AppendTransactions(ctx context.Context, transactions []*Transaction) error {
+	records := make([]fileRecord, len(transactions))
+	for i, t := range transactions {
+		records[i].Transaction = t
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.append(records)
+}
+
+func (s *FileStore) CanCommit() bool {
+	return true
+}
+
+// Commit appends the batch as a single record. If the process crashes while writing it,
+// NewFileStore cuts off the torn line, so either the whole batch is stored or none of it.
+func (s *FileStore) Commit(ctx context.Context, b *StoreBatch) error {
+	var batch []fileRecord
+	for _, u := range b.Users {
+		batch = append(batch, fileRecord{User: u})
+	}
+	for _, o := range b.Openings {
+		batch = append(batch, fileRecord{Opening: o})
+	}
+	for _, d := range b.Deposits {
+		batch = append(batch, fileRecord{Deposit: d})
+	}
+	for _, t := range b.Transactions {
+		batch = append(batch, fileRecord{Transaction: t})
+	}
+	for _, w := range b.Withdrawals {
+		batch = append(batch, fileRecord{Withdrawal: w})
+	}
+	for _, r := range b.Rounds {
+		batch = append(batch, fileRecord{Round: &fileRound{Key: r.Key, Round: r}})
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.append([]fileRecord{{Batch: batch}})
+}
+
+func (s *FileStore) LoadAll(ctx context.Context, l *StoreLoader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.file.Seek(0, 0); err != nil {
+		return err
+	}
+	users := map[uint64]*User{}
+	withdrawals := map[uint64]*Withdrawal{}
+	rounds := map[string]*Round{}
+	apiKeys := map[string]*APIKey{}
+	reader := bufio.NewReader(s.file) // Not a Scanner: a record written by Commit can be of any size
+	var load func(r *fileRecord) error
+	load = func(r *fileRecord) error {
+		switch {
+		case r.User != nil:
+			if stored, ok := users[r.User.Id]; !ok || stored.Version <= r.User.Version {
+				users[r.User.Id] = r.User
+			}
+		case r.Opening != nil:
+			return l.Opening(r.Opening)
+		case r.Deposit != nil:
+			return l.Deposit(r.Deposit)
+		case r.Transaction != nil:
+			return l.Transaction(r.Transaction)
+		case r.Withdrawal != nil:
+			withdrawals[r.Withdrawal.WithdrawalId] = r.Withdrawal
+		case r.Round != nil:
+			r.Round.Round.Key = r.Round.Key
+			rounds[r.Round.Key] = r.Round.Round
+		case r.APIKey != nil:
+			r.APIKey.APIKey.Hash = r.APIKey.Hash
+			apiKeys[r.APIKey.Id] = r.APIKey.APIKey
+		}
+		for i := range r.Batch {
+			if err := load(&r.Batch[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	line := 0
+	for {
+		b, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(b) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		line++
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var r fileRecord
+		if err := json.Unmarshal(b, &r); err != nil {
+			return fmt.Errorf("%s:%d: %w", s.file.Name(), line, err)
+		}
+		if err := load(&r); err != nil {
+			return err
+		}
+	}
+	for _, u := range users {
+		if err := l.User(u); err != nil {
+			return err
+		}
+	}
+	for _, w := range withdrawals {
+		if err := l.Withdrawal(w); err != nil {
+			return err
+		}
+	}
+	for _, r := range rounds {
+		if err := l.Round(r); err != nil {
+			return err
+		}
+	}
+	for _, k := range apiKeys {
+		if err := l.APIKey(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileStore) Ping(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.file.Stat()
+	return err
+}
+
+func (s *FileStore) Close(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
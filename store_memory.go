@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryStore keeps everything in process memory. It is meant for local runs and tests:
+// the data is lost when the process exits.
+type MemoryStore struct {
+	mu           sync.Mutex
+	users        map[uint64]*User
+	openings     []Opening
+	deposits     []Deposit
+	transactions []Transaction
+	withdrawals  map[uint64]Withdrawal
+	rounds       map[string]*Round
+	apiKeys      map[string]APIKey
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:       map[uint64]*User{},
+		withdrawals: map[uint64]Withdrawal{},
+		rounds:      map[string]*Round{},
+		apiKeys:     map[string]APIKey{},
+	}
+}
+
+func (s *MemoryStore) SaveUsers(ctx context.Context, users []*User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range users {
+		s.saveUser(u)
+	}
+	return nil
+}
+
+// saveUser keeps a copy of the user unless a newer version is stored
+func (s *MemoryStore) saveUser(u *User) {
+	if stored, ok := s.users[u.Id]; !ok || stored.Version < u.Version {
+		s.users[u.Id] = u.clone()
+	}
+}
+
+func (s *MemoryStore) SaveWithdrawals(ctx context.Context, withdrawals []*Withdrawal) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, w := range withdrawals {
+		s.withdrawals[w.WithdrawalId] = *w
+	}
+	return nil
+}
+
+func (s *MemoryStore) SaveRounds(ctx context.Context, rounds []*Round) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range rounds {
+		s.rounds[r.Key] = r.clone()
+	}
+	return nil
+}
+
+func (s *MemoryStore) SaveAPIKeys(ctx context.Context, keys []*APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range keys {
+		s.apiKeys[k.Id] = *k
+	}
+	return nil
+}
+
+func (s *MemoryStore) AppendOpenings(ctx context.Context, openings []*Opening) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, o := range openings {
+		s.openings = append(s.openings, *o)
+	}
+	return nil
+}
+
+func (s *MemoryStore) AppendDeposits(ctx context.Context, deposits []*Deposit) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range deposits {
+		s.deposits = append(s.deposits, *d)
+	}
+	return nil
+}
+
+func (s *MemoryStore) AppendTransactions(ctx context.Context, transactions []*Transaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range transactions {
+		s.transactions = append(s.transactions, *t)
+	}
+	return nil
+}
+
+func (s *MemoryStore) CanCommit() bool {
+	return true
+}
+
+func (s *MemoryStore) Commit(ctx context.Context, b *StoreBatch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range b.Users {
+		s.saveUser(u)
+	}
+	for _, o := range b.Openings {
+		s.openings = append(s.openings, *o)
+	}
+	for _, d := range b.Deposits {
+		s.deposits = append(s.deposits, *d)
+	}
+	for _, t := range b.Transactions {
+		s.transactions = append(s.transactions, *t)
+	}
+	for _, w := range b.Withdrawals {
+		s.withdrawals[w.WithdrawalId] = *w
+	}
+	for _, r := range b.Rounds {
+		s.rounds[r.Key] = r.clone()
+	}
+	return nil
+}
+
+func (s *MemoryStore) LoadAll(ctx context.Context, l *StoreLoader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if err := l.User(u.clone()); err != nil {
+			return err
+		}
+	}
+	for _, o := range s.openings {
+		o := o
+		if err := l.Opening(&o); err != nil {
+			return err
+		}
+	}
+	for _, d := range s.deposits {
+		d := d
+		if err := l.Deposit(&d); err != nil {
+			return err
+		}
+	}
+	for _, t := range s.transactions {
+		t := t
+		if err := l.Transaction(&t); err != nil {
+			return err
+		}
+	}
+	for _, w := range s.withdrawals {
+		w := w
+		if err := l.Withdrawal(&w); err != nil {
+			return err
+		}
+	}
+	for _, r := range s.rounds {
+		if err := l.Round(r.clone()); err != nil {
+			return err
+		}
+	}
+	for _, k := range s.apiKeys {
+		k := k
+		if err := l.APIKey(&k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *MemoryStore) Close(ctx context.Context) error {
+	return nil
+}
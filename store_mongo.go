@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+const mongoIndexMaxTime = time.Minute
+const mongoDefaultBatchSize = 1000
+const mongoDefaultBatchTimeout = 5 * time.Second
+const mongoDefaultOpeningsCollection = "openings" // The collection is newer than the others
+
+type MongoStoreConfig struct {
+	URL                    string        `yaml:"url"`
+	Username               string        `yaml:"username"` // Overrides the credentials of URL if set
+	Password               string        `yaml:"password"`
+	DbName                 string        `yaml:"dbname"`
+	UsersCollection        string        `yaml:"users_collection"`
+	OpeningsCollection     string        `yaml:"openings_collection"` // mongoDefaultOpeningsCollection if empty
+	DepositsCollection     string        `yaml:"deposits_collection"`
+	TransactionsCollection string        `yaml:"transactions_collection"`
+	WithdrawalsCollection  string        `yaml:"withdrawals_collection"`
+	RoundsCollection       string        `yaml:"rounds_collection"`
+	APIKeysCollection      string        `yaml:"apikeys_collection"`
+	BatchSize              int           `yaml:"batch_size"`    // Documents per bulk write, mongoDefaultBatchSize if 0
+	BatchTimeout           time.Duration `yaml:"batch_timeout"` // Max time of a bulk write, mongoDefaultBatchTimeout if 0
+}
+
+// MongoStore keeps users, openings, deposits, transactions, withdrawals, rounds and API keys in seven MongoDB collections
+type MongoStore struct {
+	client          *mongo.Client
+	ctxCancel       context.CancelFunc // Cancel function for the client.Connect context
+	colUsers        *mongo.Collection
+	colOpenings     *mongo.Collection
+	colDeposits     *mongo.Collection
+	colTransactions *mongo.Collection
+	colWithdrawals  *mongo.Collection
+	colRounds       *mongo.Collection
+	colAPIKeys      *mongo.Collection
+	batchSize       int
+	batchTimeout    time.Duration
+	transactions    bool // See CanCommit
+}
+
+func NewMongoStore(ctx context.Context, cfg MongoStoreConfig) (*MongoStore, error) {
+	opts := options.Client().ApplyURI(cfg.URL)
+	if cfg.Username != "" {
+		opts.SetAuth(options.Credential{Username: cfg.Username, Password: cfg.Password})
+	}
+	client, err := mongo.NewClient(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &MongoStore{client: client, batchSize: cfg.BatchSize, batchTimeout: cfg.BatchTimeout}
+	if s.batchSize <= 0 {
+		s.batchSize = mongoDefaultBatchSize
+	}
+	if s.batchTimeout <= 0 {
+		s.batchTimeout = mongoDefaultBatchTimeout
+	}
+	var ctxConnect context.Context // This context will be active while the server runs
+	ctxConnect, s.ctxCancel = context.WithCancel(context.Background())
+
+	err = client.Connect(ctxConnect)
+	if err != nil {
+		s.ctxCancel()
+		return nil, err
+	}
+
+	db := client.Database(cfg.DbName)
+	s.colUsers = db.Collection(cfg.UsersCollection)
+	if cfg.OpeningsCollection == "" {
+		cfg.OpeningsCollection = mongoDefaultOpeningsCollection
+	}
+	s.colOpenings = db.Collection(cfg.OpeningsCollection)
+	s.colDeposits = db.Collection(cfg.DepositsCollection)
+	s.colTransactions = db.Collection(cfg.TransactionsCollection)
+	s.colWithdrawals = db.Collection(cfg.WithdrawalsCollection)
+	s.colRounds = db.Collection(cfg.RoundsCollection)
+	s.colAPIKeys = db.Collection(cfg.APIKeysCollection)
+
+	if err := s.ensureIndexes(ctx); err != nil {
+		s.Close(ctx)
+		return nil, err
+	}
+	if err := s.detectTransactions(ctx); err != nil {
+		s.Close(ctx)
+		return nil, err
+	}
+	return s, nil
+}
+
+// detectTransactions finds out whether the deployment supports transactions
+func (s *MongoStore) detectTransactions(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, mongoIndexMaxTime)
+	defer cancel()
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	err := s.client.Database("admin").RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&hello)
+	if err != nil {
+		return err
+	}
+	s.transactions = hello.SetName != "" || hello.Msg == "isdbgrid"
+	return nil
+}
+
+// ensureIndexes creates the indexes for the history queries of a user
+func (s *MongoStore) ensureIndexes(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, mongoIndexMaxTime)
+	defer cancel()
+	userTime := mongo.IndexModel{Keys: bson.D{{Key: "userid", Value: 1}, {Key: "time", Value: 1}}}
+	for _, col := range []*mongo.Collection{s.colDeposits, s.colTransactions, s.colWithdrawals} {
+		if _, err := col.Indexes().CreateOne(ctx, userTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveUsers replaces the stored users that are older than the given ones (see User.Version) and inserts the missing ones.
+// Each user takes two models, neither of which fails when the stored user is newer, also in a transaction.
+func (s *MongoStore) SaveUsers(ctx context.Context, users []*User) error {
+	models := make([]mongo.WriteModel, 0, 2*len(users))
+	for _, u := range users {
+		older := bson.D{
+			{Key: "_id", Value: u.Id},
+			{Key: "$or", Value: bson.A{
+				bson.D{{Key: "version", Value: bson.D{{Key: "$lt", Value: u.Version}}}},
+				bson.D{{Key: "version", Value: bson.D{{Key: "$exists", Value: false}}}}, // Stored by older versions
+			}},
+		}
+		models = append(models,
+			mongo.NewReplaceOneModel().SetFilter(older).SetReplacement(u),
+			appendModel(u.Id, u, true))
+	}
+	err := s.bulkWrite(ctx, s.colUsers, models)
+	if errs, ok := err.(StoreErrors); ok {
+		for _, e := range errs {
+			if ie, ok := e.(*StoreItemError); ok {
+				ie.Index /= 2 // Index of the user
+			}
+		}
+	}
+	return err
+}
+
+func (s *MongoStore) SaveWithdrawals(ctx context.Context, withdrawals []*Withdrawal) error {
+	models := make([]mongo.WriteModel, len(withdrawals))
+	for i, w := range withdrawals {
+		models[i] = mongo.NewReplaceOneModel().SetFilter(bson.D{{Key: "_id", Value: w.WithdrawalId}}).SetReplacement(w).SetUpsert(true)
+	}
+	return s.bulkWrite(ctx, s.colWithdrawals, models)
+}
+
+func (s *MongoStore) SaveRounds(ctx context.Context, rounds []*Round) error {
+	models := make([]mongo.WriteModel, len(rounds))
+	for i, r := range rounds {
+		models[i] = mongo.NewReplaceOneModel().SetFilter(bson.D{{Key: "_id", Value: r.Key}}).SetReplacement(r).SetUpsert(true)
+	}
+	return s.bulkWrite(ctx, s.colRounds, models)
+}
+
+func (s *MongoStore) SaveAPIKeys(ctx context.Context, keys []*APIKey) error {
+	models := make([]mongo.WriteModel, len(keys))
+	for i, k := range keys {
+		models[i] = mongo.NewReplaceOneModel().SetFilter(bson.D{{Key: "_id", Value: k.Id}}).SetReplacement(k).SetUpsert(true)
+	}
+	return s.bulkWrite(ctx, s.colAPIKeys, models)
+}
+
+func (s *MongoStore) AppendOpenings(ctx context.Context, openings []*Opening) error {
+	return s.appendOpenings(ctx, openings, false)
+}
+
+func (s *MongoStore) AppendDeposits(ctx context.Context, deposits []*Deposit) error {
+	return s.appendDeposits(ctx, deposits, false)
+}
+
+func (s *MongoStore) AppendTransactions(ctx context.Context, transactions []*Transaction) error {
+	return s.appendTransactions(ctx, transactions, false)
+}
+
+func (s *MongoStore) appendOpenings(ctx context.Context, openings []*Opening, inTransaction bool) error {
+	models := make([]mongo.WriteModel, len(openings))
+	for i, o := range openings {
+		models[i] = appendModel(o.Key, o, inTransaction)
+	}
+	return s.bulkWrite(ctx, s.colOpenings, models)
+}
+
+func (s *MongoStore) appendDeposits(ctx context.Context, deposits []*Deposit, inTransaction bool) error {
+	models := make([]mongo.WriteModel, len(deposits))
+	for i, d := range deposits {
+		models[i] = appendModel(d.DepositId, d, inTransaction)
+	}
+	return s.bulkWrite(ctx, s.colDeposits, models)
+}
+
+func (s *MongoStore) appendTransactions(ctx context.Context, transactions []*Transaction, inTransaction bool) error {
+	models := make([]mongo.WriteModel, len(transactions))
+	for i, t := range transactions {
+		models[i] = appendModel(t.TransactionId, t, inTransaction)
+	}
+	return s.bulkWrite(ctx, s.colTransactions, models)
+}
+
+// appendModel returns the model that inserts an append-only document. A duplicate key error of an insert
+// would abort a transaction, so in a transaction the document is upserted with $setOnInsert instead,
+// which leaves a document inserted by an earlier attempt as it is.
+func appendModel(id, doc interface{}, inTransaction bool) mongo.WriteModel {
+	if !inTransaction {
+		return mongo.NewInsertOneModel().SetDocument(doc)
+	}
+	return mongo.NewUpdateOneModel().
+		SetFilter(bson.D{{Key: "_id", Value: id}}).
+		SetUpdate(bson.D{{Key: "$setOnInsert", Value: doc}}).
+		SetUpsert(true)
+}
+
+// bulkWrite writes the documents in unordered batches of batchSize, each with its own timeout,
+// and returns the errors of the documents that were not written as StoreErrors.
+// A duplicate key error of an insert is not an error: the document was inserted by an earlier attempt.
+func (s *MongoStore) bulkWrite(ctx context.Context, col *mongo.Collection, models []mongo.WriteModel) error {
+	var errs StoreErrors
+	for start := 0; start < len(models); start += s.batchSize {
+		end := start + s.batchSize
+		if end > len(models) {
+			end = len(models)
+		}
+		batchCtx, cancel := context.WithTimeout(ctx, s.batchTimeout)
+		_, err := col.BulkWrite(batchCtx, models[start:end], options.BulkWrite().SetOrdered(false))
+		cancel()
+		if err == nil {
+			continue
+		}
+		if bwe, ok := err.(mongo.BulkWriteException); ok && bwe.WriteConcernError == nil {
+			for _, we := range bwe.WriteErrors {
+				if !isDuplicateKeyWriteError(we.WriteError) {
+					errs = append(errs, &StoreItemError{Index: start + we.Index, Err: we.WriteError})
+				}
+			}
+			continue
+		}
+		// The batch failed as a whole, some of its documents may have been written nevertheless
+		for i := start; i < end; i++ {
+			errs = append(errs, &StoreItemError{Index: i, Err: err})
+		}
+	}
+	return errs.orNil()
+}
+
+func isDuplicateKeyWriteError(we mongo.WriteError) bool {
+	switch we.Code {
+	case 11000, 11001, 12582:
+		return true
+	case 16460:
+		return strings.Contains(we.Message, " E11000 ")
+	}
+	return false
+}
+
+// CanCommit tells whether the deployment supports multi-document transactions: a replica set or a sharded cluster
+func (s *MongoStore) CanCommit() bool {
+	return s.transactions
+}
+
+// Commit writes the batch in a multi-document transaction
+func (s *MongoStore) Commit(ctx context.Context, b *StoreBatch) error {
+	if !s.transactions {
+		return errors.New("the MongoDB deployment does not support transactions")
+	}
+	session, err := s.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		if err := s.SaveUsers(sc, b.Users); err != nil {
+			return nil, err
+		}
+		if err := s.appendOpenings(sc, b.Openings, true); err != nil {
+			return nil, err
+		}
+		if err := s.appendDeposits(sc, b.Deposits, true); err != nil {
+			return nil, err
+		}
+		if err := s.appendTransactions(sc, b.Transactions, true); err != nil {
+			return nil, err
+		}
+		if err := s.SaveWithdrawals(sc, b.Withdrawals); err != nil {
+			return nil, err
+		}
+		return nil, s.SaveRounds(sc, b.Rounds)
+	})
+	if err != nil {
+		return fmt.Errorf("transaction aborted: %w", err) // Not StoreErrors: nothing was written
+	}
+	return nil
+}
+
+func (s *MongoStore) LoadAll(ctx context.Context, l *StoreLoader) error {
+	err := streamCollection(ctx, s.colUsers, func(cur *mongo.Cursor) error {
+		u := new(User)
+		if err := cur.Decode(u); err != nil {
+			return err
+		}
+		return l.User(u)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Ledger entries are streamed in insertion order
+	err = streamCollection(ctx, s.colOpenings, func(cur *mongo.Cursor) error {
+		o := new(Opening)
+		if err := cur.Decode(o); err != nil {
+			return err
+		}
+		return l.Opening(o)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = streamCollection(ctx, s.colDeposits, func(cur *mongo.Cursor) error {
+		d := new(Deposit)
+		if err := cur.Decode(d); err != nil {
+			return err
+		}
+		return l.Deposit(d)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = streamCollection(ctx, s.colTransactions, func(cur *mongo.Cursor) error {
+		t := new(Transaction)
+		if err := cur.Decode(t); err != nil {
+			return err
+		}
+		return l.Transaction(t)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = streamCollection(ctx, s.colWithdrawals, func(cur *mongo.Cursor) error {
+		w := new(Withdrawal)
+		if err := cur.Decode(w); err != nil {
+			return err
+		}
+		return l.Withdrawal(w)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = streamCollection(ctx, s.colRounds, func(cur *mongo.Cursor) error {
+		r := new(Round)
+		if err := cur.Decode(r); err != nil {
+			return err
+		}
+		return l.Round(r)
+	})
+	if err != nil {
+		return err
+	}
+
+	return streamCollection(ctx, s.colAPIKeys, func(cur *mongo.Cursor) error {
+		k := new(APIKey)
+		if err := cur.Decode(k); err != nil {
+			return err
+		}
+		return l.APIKey(k)
+	})
+}
+
+// streamCollection calls fn for every document of the collection
+func streamCollection(ctx context.Context, col *mongo.Collection, fn func(cur *mongo.Cursor) error) error {
+	cur, err := col.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "$natural", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		if err := fn(cur); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+func (s *MongoStore) Migrate(ctx context.Context, defaultCurrency string) (int, error) {
+	n := 0
+
+	// Single-currency users: move the balance and the statistics into a wallet
+	toMoney := func(field string) bson.D {
+		return bson.D{{Key: "$round", Value: bson.A{
+			bson.D{{Key: "$toDecimal", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$" + field, 0}}}}},
+			MoneyDecimals,
+		}}}
+	}
+	toCount := func(field string) bson.D {
+		return bson.D{{Key: "$toLong", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$" + field, 0}}}}}
+	}
+	res, err := s.colUsers.UpdateMany(ctx,
+		bson.D{{Key: "wallets", Value: bson.D{{Key: "$exists", Value: false}}}},
+		bson.A{
+			bson.D{{Key: "$set", Value: bson.D{{Key: "wallets", Value: bson.D{{Key: defaultCurrency, Value: bson.D{
+				{Key: "currency", Value: bson.D{{Key: "$literal", Value: defaultCurrency}}},
+				{Key: "balance", Value: toMoney("balance")},
+				{Key: "depositcount", Value: toCount("depositcount")},
+				{Key: "depositsum", Value: toMoney("depositsum")},
+				{Key: "betcount", Value: toCount("betcount")},
+				{Key: "betsum", Value: toMoney("betsum")},
+				{Key: "wincount", Value: toCount("wincount")},
+				{Key: "winsum", Value: toMoney("winsum")},
+			}}}}}}},
+			bson.D{{Key: "$unset", Value: bson.A{"balance", "depositcount", "depositsum", "betcount", "betsum", "wincount", "winsum"}}},
+		})
+	if err != nil {
+		return n, err
+	}
+	n += int(res.ModifiedCount)
+
+	// Single-currency deposits and transactions
+	for _, col := range []*mongo.Collection{s.colDeposits, s.colTransactions} {
+		res, err := col.UpdateMany(ctx,
+			bson.D{{Key: "currency", Value: bson.D{{Key: "$exists", Value: false}}}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "currency", Value: defaultCurrency}}}})
+		if err != nil {
+			return n, err
+		}
+		n += int(res.ModifiedCount)
+	}
+
+	// Amounts stored as doubles: Money decodes them, replacing the document writes them back exactly
+	migrateMoney := func(col *mongo.Collection, newDoc func() interface{}) error {
+		cur, err := col.Find(ctx, bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "amount", Value: bson.D{{Key: "$type", Value: "double"}}}},
+			bson.D{{Key: "balancebefore", Value: bson.D{{Key: "$type", Value: "double"}}}},
+			bson.D{{Key: "balanceafter", Value: bson.D{{Key: "$type", Value: "double"}}}},
+		}}})
+		if err != nil {
+			return err
+		}
+		defer cur.Close(ctx)
+		for cur.Next(ctx) {
+			doc := newDoc()
+			if err := cur.Decode(doc); err != nil {
+				return err
+			}
+			_, err := col.ReplaceOne(ctx, bson.D{{Key: "_id", Value: cur.Current.Lookup("_id")}}, doc)
+			if err != nil {
+				return err
+			}
+			n++
+		}
+		return cur.Err()
+	}
+	err = migrateMoney(s.colDeposits, func() interface{} { return new(Deposit) })
+	if err != nil {
+		return n, err
+	}
+	err = migrateMoney(s.colTransactions, func() interface{} { return new(Transaction) })
+	return n, err
+}
+
+func (s *MongoStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx, readpref.Primary())
+}
+
+func (s *MongoStore) Close(ctx context.Context) error {
+	err := s.client.Disconnect(ctx)
+	s.ctxCancel()
+	return err
+}
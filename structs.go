@@ -3,57 +3,300 @@ package main
 import "time"
 
 type User struct {
-	Id           uint64  `json:"id" bson:"_id"`
-	Balance      float64 `json:"balance"`
-	DepositCount uint64  `json:"depositcount"`
-	DepositSum   float64 `json:"depositsum"`
-	BetCount     uint64  `json:"betcount"`
-	BetSum       float64 `json:"betsum"`
-	WinCount     uint64  `json:"wincount"`
-	WinSum       float64 `json:"winsum"`
+	Id        uint64             `json:"id" bson:"_id"`
+	Version   uint64             `json:"version"` // Incremented by every change, a stored user is only replaced by a newer version
+	Wallets   map[string]*Wallet `json:"wallets"` // By currency
+	CreatedAt time.Time          `json:"createdat"`
+}
+
+// clone returns a deep copy of the user
+func (u *User) clone() *User {
+	c := *u
+	c.Wallets = make(map[string]*Wallet, len(u.Wallets))
+	for k, w := range u.Wallets {
+		wc := *w
+		c.Wallets[k] = &wc
+	}
+	return &c
+}
+
+// Wallet is the balance and the statistics of a user in one currency
+type Wallet struct {
+	Currency       string `json:"currency"`
+	InitialBalance Money  `json:"initialbalance"` // Given when the wallet was created, see Opening
+	Balance        Money  `json:"balance"`
+	DepositCount   uint64 `json:"depositcount"`
+	DepositSum     Money  `json:"depositsum"`
+	BetCount       uint64 `json:"betcount"`
+	BetSum         Money  `json:"betsum"`
+	WinCount       uint64 `json:"wincount"`
+	WinSum         Money  `json:"winsum"`
+	WithdrawCount  uint64 `json:"withdrawcount"` // Withdrawals that are not rejected
+	WithdrawSum    Money  `json:"withdrawsum"`
+	Reserved       Money  `json:"reserved"` // Pending and approved withdrawals, already taken from the balance
+}
+
+// The operations below change the balance of a wallet together with its totals. If one of them would be
+// out of the range of Money, they return errMoneyRange and leave the wallet unchanged.
+
+func (w *Wallet) deposit(amount Money) error {
+	balance, err := w.Balance.Add(amount)
+	if err != nil {
+		return err
+	}
+	sum, err := w.DepositSum.Add(amount)
+	if err != nil {
+		return err
+	}
+	w.Balance, w.DepositSum = balance, sum
+	w.DepositCount++
+	return nil
+}
+
+func (w *Wallet) bet(amount Money) error {
+	balance, err := w.Balance.Sub(amount)
+	if err != nil {
+		return err
+	}
+	sum, err := w.BetSum.Add(amount)
+	if err != nil {
+		return err
+	}
+	w.Balance, w.BetSum = balance, sum
+	w.BetCount++
+	return nil
+}
+
+func (w *Wallet) win(amount Money) error {
+	balance, err := w.Balance.Add(amount)
+	if err != nil {
+		return err
+	}
+	sum, err := w.WinSum.Add(amount)
+	if err != nil {
+		return err
+	}
+	w.Balance, w.WinSum = balance, sum
+	w.WinCount++
+	return nil
+}
+
+// rollBack gives back a bet of the amount
+func (w *Wallet) rollBack(amount Money) error {
+	balance, err := w.Balance.Add(amount)
+	if err != nil {
+		return err
+	}
+	sum, err := w.BetSum.Sub(amount)
+	if err != nil {
+		return err
+	}
+	w.Balance, w.BetSum = balance, sum
+	w.BetCount--
+	return nil
+}
+
+// reserve takes a withdrawal of the amount from the balance
+func (w *Wallet) reserve(amount Money) error {
+	balance, err := w.Balance.Sub(amount)
+	if err != nil {
+		return err
+	}
+	reserved, err := w.Reserved.Add(amount)
+	if err != nil {
+		return err
+	}
+	sum, err := w.WithdrawSum.Add(amount)
+	if err != nil {
+		return err
+	}
+	w.Balance, w.Reserved, w.WithdrawSum = balance, reserved, sum
+	w.WithdrawCount++
+	return nil
+}
+
+// release gives back a rejected withdrawal of the amount
+func (w *Wallet) release(amount Money) error {
+	balance, err := w.Balance.Add(amount)
+	if err != nil {
+		return err
+	}
+	reserved, err := w.Reserved.Sub(amount)
+	if err != nil {
+		return err
+	}
+	sum, err := w.WithdrawSum.Sub(amount)
+	if err != nil {
+		return err
+	}
+	w.Balance, w.Reserved, w.WithdrawSum = balance, reserved, sum
+	w.WithdrawCount--
+	return nil
+}
+
+// Opening is the ledger entry of the initial balance of a wallet, given when the user or the wallet was created
+type Opening struct {
+	Key      string    `json:"key" bson:"_id"` // See openingKey
+	UserId   uint64    `json:"userid"`
+	Currency string    `json:"currency"`
+	Amount   Money     `json:"amount"`
+	APIKeyId string    `json:"apikeyid"` // Of the request that created the wallet
+	Time     time.Time `json:"time"`
 }
 
 type Deposit struct {
 	DepositId     uint64    `json:"depositid" bson:"_id"`
 	UserId        uint64    `json:"userid"`
-	Amount        float64   `json:"amount"`
-	BalanceBefore float64   `json:"balancabefore"`
-	BalanceAfter  float64   `json:"balanceafter"`
+	Currency      string    `json:"currency"`
+	Amount        Money     `json:"amount"`
+	BalanceBefore Money     `json:"balancabefore"`
+	BalanceAfter  Money     `json:"balanceafter"`
 	Time          time.Time `json:"time"`
 }
 
 type Transaction struct {
-	TransactionId uint64    `json:"transactionid" bson:"_id"`
-	UserId        uint64    `json:"userid"`
-	Type          string    `json:"type"`
-	Amount        float64   `json:"amount"`
-	BalanceBefore float64   `json:"balancebefore"`
-	BalanceAfter  float64   `json:"balanceafter"`
-	Time          time.Time `json:"time"`
+	TransactionId    uint64    `json:"transactionid" bson:"_id"`
+	UserId           uint64    `json:"userid"`
+	Type             string    `json:"type"` // "Bet", "Win" or "Rollback"
+	Currency         string    `json:"currency"`
+	Amount           Money     `json:"amount"`
+	RefTransactionId uint64    `json:"reftransactionid,omitempty" bson:",omitempty"` // The bet cancelled by a "Rollback"
+	RolledBackBy     uint64    `json:"rolledbackby,omitempty" bson:"-"`              // The "Rollback" of a bet, restored at load
+	RoundId          string    `json:"roundid,omitempty" bson:",omitempty"`
+	BalanceBefore    Money     `json:"balancebefore"`
+	BalanceAfter     Money     `json:"balanceafter"`
+	Time             time.Time `json:"time"`
+}
+
+// clone returns a copy of the transaction
+func (t *Transaction) clone() *Transaction {
+	c := *t
+	return &c
+}
+
+// Round is a game round of a user: the bets and wins sent by a provider with the same round ID.
+// A round is opened by its first transaction and stays open until it is closed explicitly.
+type Round struct {
+	Key            string     `json:"-" bson:"_id"` // See roundKey
+	RoundId        string     `json:"roundid"`
+	UserId         uint64     `json:"userid"`
+	Currency       string     `json:"currency"`
+	Status         string     `json:"status"` // "open" or "closed"
+	BetSum         Money      `json:"betsum"` // Rolled back bets excluded
+	WinSum         Money      `json:"winsum"`
+	TransactionIds []uint64   `json:"transactionids"`
+	OpenedAt       time.Time  `json:"openedat"`
+	ClosedAt       *time.Time `json:"closedat,omitempty" bson:",omitempty"`
+}
+
+// Withdrawal is a payout to a user. The amount is taken from the balance when the withdrawal is requested
+// and returned to it if the withdrawal gets rejected.
+type Withdrawal struct {
+	WithdrawalId         uint64    `json:"withdrawalid" bson:"_id"`
+	UserId               uint64    `json:"userid"`
+	Currency             string    `json:"currency"`
+	Amount               Money     `json:"amount"`
+	Status               string    `json:"status"` // "pending", "approved", "paid" or "rejected"
+	BalanceBefore        Money     `json:"balancebefore"`
+	BalanceAfter         Money     `json:"balanceafter"`
+	ReleaseBalanceBefore Money     `json:"releasebalancebefore,omitempty" bson:",omitempty"` // When rejected
+	ReleaseBalanceAfter  Money     `json:"releasebalanceafter,omitempty" bson:",omitempty"`
+	Time                 time.Time `json:"time"`      // Of the request
+	UpdatedAt            time.Time `json:"updatedat"` // Of the last status change
 }
 
 type AddUserInput struct {
-	Id      uint64  `json:"id" binding:"required"`
-	Balance float64 `json:"balance" binding:"required"`
-	Token   string  `json:"token" binding:"required"`
+	Id       uint64 `json:"id" binding:"required"`
+	Currency string `json:"currency" binding:"required"` // Currency of the first wallet
+	Balance  Money  `json:"balance"`
 }
 
 type GetUserInput struct {
-	Id    uint64 `json:"id" binding:"required"`
-	Token string `json:"token" binding:"required"`
+	Id uint64 `json:"id" binding:"required"`
+}
+
+type AddWalletInput struct {
+	UserId   uint64 `json:"userid" binding:"required"`
+	Currency string `json:"currency" binding:"required"`
+	Balance  Money  `json:"balance"`
 }
 
 type AddDepositInput struct {
-	DepositId uint64  `json:"depositid" binding:"required"`
-	UserId    uint64  `json:"userid" binding:"required"`
-	Amount    float64 `json:"amount" binding:"required"`
-	Token     string  `json:"token" binding:"required"`
+	DepositId uint64 `json:"depositid" binding:"required"`
+	UserId    uint64 `json:"userid" binding:"required"`
+	Currency  string `json:"currency" binding:"required"`
+	Amount    Money  `json:"amount" binding:"required"`
 }
 
 type AddTransactionInput struct {
-	TransactionId uint64  `json:"transactionid"  binding:"required"`
-	UserId        uint64  `json:"userid" binding:"required"`
-	Type          string  `json:"type" binding:"required"`
-	Amount        float64 `json:"amount" binding:"required"`
-	Token         string  `json:"token" binding:"required"`
+	TransactionId    uint64 `json:"transactionid"  binding:"required"`
+	UserId           uint64 `json:"userid" binding:"required"`
+	Type             string `json:"type" binding:"required"`
+	Currency         string `json:"currency" binding:"required"`
+	Amount           Money  `json:"amount"`                                               // Required for "Bet" and "Win", optional for "Rollback"
+	RefTransactionId uint64 `json:"reftransactionid" binding:"required_if=Type Rollback"` // The bet to roll back
+	RoundId          string `json:"roundid"`                                              // Optional game round
+}
+
+type AddWithdrawalInput struct {
+	WithdrawalId uint64 `json:"withdrawalid" binding:"required"`
+	UserId       uint64 `json:"userid" binding:"required"`
+	Currency     string `json:"currency" binding:"required"`
+	Amount       Money  `json:"amount" binding:"required"`
+}
+
+type GetWithdrawalInput struct {
+	WithdrawalId uint64 `json:"withdrawalid" binding:"required"`
+}
+
+type SetWithdrawalStatusInput struct {
+	WithdrawalId uint64 `json:"withdrawalid" binding:"required"`
+	Status       string `json:"status" binding:"required"`
+}
+
+type RoundInput struct {
+	UserId  uint64 `json:"userid" binding:"required"`
+	RoundId string `json:"roundid" binding:"required"`
+}
+
+type GetUserRoundsInput struct {
+	UserId uint64 `json:"userid" binding:"required"`
+	Status string `json:"status"` // "open" or "closed", all rounds if empty
+}
+
+type CreateAPIKeyInput struct {
+	Label     string     `json:"label" binding:"required"`
+	Role      string     `json:"role" binding:"required,oneof=admin client"`
+	ExpiresAt *time.Time `json:"expiresat"`
+}
+
+type APIKeyInput struct {
+	Id string `json:"id" binding:"required"`
+}
+
+type RotateAPIKeyInput struct {
+	Id          string     `json:"id" binding:"required"`
+	ExpiresAt   *time.Time `json:"expiresat"`   // Of the new key
+	GracePeriod int64      `json:"graceperiod"` // Seconds the old key stays valid, it is revoked at once if 0
+}
+
+type HistoryInput struct {
+	UserId    uint64     `json:"userid" binding:"required"`
+	Type      string     `json:"type"` // Transactions only
+	Currency  string     `json:"currency"`
+	MinAmount *Money     `json:"minamount"`
+	MaxAmount *Money     `json:"maxamount"`
+	From      *time.Time `json:"from"`
+	To        *time.Time `json:"to"`
+	Order     string     `json:"order" binding:"omitempty,oneof=asc desc"` // By time, "desc" by default
+	Limit     int        `json:"limit" binding:"omitempty,min=1,max=1000"`
+	Cursor    string     `json:"cursor"` // "nextcursor" of the previous page
+}
+
+type RedriveDeadLettersInput struct {
+	Keys []string `json:"keys"` // All dead letters if empty
+}
+
+type CheckInvariantsInput struct {
+	Source string `json:"source" binding:"omitempty,oneof=memory db"` // "memory" by default
 }
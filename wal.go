@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// The write-ahead log (WAL) makes the acknowledged operations survive a crash between two DB syncs.
+// Every operation appends an entry with the objects it changed and syncs it to disk before the response is sent.
+// The log is split into segments: DbUpdate starts a new segment when it takes the objects to persist,
+// and deletes the older segments once they are all persisted. At startup the segments left over
+// are replayed on top of the state loaded from DB.
+
+// walEntry holds the state of the objects changed by one operation right after it, see commitOperation
+type walEntry struct {
+	User        *User        `json:"user,omitempty"`
+	Opening     *Opening     `json:"opening,omitempty"`
+	Deposit     *Deposit     `json:"deposit,omitempty"`
+	Transaction *Transaction `json:"transaction,omitempty"`
+	Withdrawal  *Withdrawal  `json:"withdrawal,omitempty"`
+	Round       *fileRound   `json:"round,omitempty"`
+}
+
+var walMutex sync.Mutex // For the WAL variables below
+var walDir string
+var walFile *os.File
+var walSegment uint64  // Number of the segment being written
+var walEnabled = false // Set by WalOpen
+var walWritten uint64  // Entries written so far
+
+var walSyncMutex sync.Mutex // For walSynced, held while syncing the WAL to disk
+var walSynced uint64        // Entries synced to disk so far
+
+func walSegmentPath(n uint64) string {
+	return filepath.Join(walDir, fmt.Sprintf("wal-%016d.log", n))
+}
+
+// walSegments returns the numbers of the existing segments in ascending order
+func walSegments() ([]uint64, error) {
+	paths, err := filepath.Glob(filepath.Join(walDir, "wal-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	var segments []uint64
+	for _, p := range paths {
+		var n uint64
+		if _, err := fmt.Sscanf(filepath.Base(p), "wal-%016d.log", &n); err == nil {
+			segments = append(segments, n)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// WalOpen opens the WAL in the directory. The existing segments are kept for WalReplay,
+// new entries go to a new segment.
+func WalOpen(dir string) error {
+	walMutex.Lock()
+	defer walMutex.Unlock()
+
+	walDir = dir
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	segments, err := walSegments()
+	if err != nil {
+		return err
+	}
+	walSegment = 1
+	if len(segments) > 0 {
+		walSegment = segments[len(segments)-1] + 1
+	}
+	walFile, err = os.OpenFile(walSegmentPath(walSegment), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	walEnabled = true
+	return nil
+}
+
+// walLog appends the entry to the WAL and syncs it to disk. It must be called with the locks of the users
+// of the objects held, after the operation has changed the objects and before it is acknowledged.
+// The operations of different users share the syncs: one sync covers all the entries written before it.
+// If the entry cannot be written, the process exits: the operation is not acknowledged,
+// and all the acknowledged ones are either in DB or in the WAL.
+func walLog(e *walEntry) {
+	if !walEnabled {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		LogFatal("WAL: failed to encode an entry", append(e.logFields(), "error", err)...)
+	}
+	walMutex.Lock()
+	if _, err := walFile.Write(append(b, '\n')); err != nil {
+		LogFatal("WAL: failed to write an entry", append(e.logFields(), "error", err)...)
+	}
+	walWritten++
+	n := walWritten
+	walMutex.Unlock()
+
+	walSyncMutex.Lock()
+	defer walSyncMutex.Unlock()
+	if walSynced >= n {
+		return // Synced together with a later entry
+	}
+	// The file is not rotated meanwhile: walRotate is called with the locks of all users held
+	walMutex.Lock()
+	f, written := walFile, walWritten
+	walMutex.Unlock()
+	if err := f.Sync(); err != nil {
+		LogFatal("WAL: failed to sync", append(e.logFields(), "error", err)...)
+	}
+	walSynced = written
+}
+
+// walRotate starts a new segment and returns the number of the last sealed one.
+// It must be called with the locks of all users held, together with taking the objects to persist,
+// so that the sealed segments hold exactly the operations being persisted (and older ones).
+func walRotate() uint64 {
+	if !walEnabled {
+		return 0
+	}
+	walMutex.Lock()
+	defer walMutex.Unlock()
+	f, err := os.OpenFile(walSegmentPath(walSegment+1), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		// Keep writing to the current segment, it will be deleted with the next sync
+		LogError("WAL: cannot start a new segment", "error", err)
+		return walSegment - 1
+	}
+	walFile.Close()
+	walFile = f
+	walSegment++
+	return walSegment - 1
+}
+
+// walPersisted is called after a DB sync. If everything in the segments up to sealed is persisted
+// (or kept as a dead letter), they are deleted. Otherwise they are kept, to be deleted by a later sync
+// or replayed at the next start.
+func walPersisted(sealed uint64, ok bool) {
+	if !walEnabled || !ok {
+		return
+	}
+	walMutex.Lock()
+	defer walMutex.Unlock()
+	segments, err := walSegments()
+	if err != nil {
+		LogError("WAL: failed to list the segments", "error", err)
+		return
+	}
+	for _, n := range segments {
+		if n <= sealed {
+			if err := os.Remove(walSegmentPath(n)); err != nil {
+				LogError("WAL: failed to delete a segment", "error", err)
+			}
+		}
+	}
+}
+
+// WalReplay applies the entries of the segments left over from the previous run on top of the state
+// loaded from DB, and marks the replayed objects as needing an update in DB. It must be called before the server handles requests.
+// Only the last entry of the last segment may be incomplete: it is a write torn by a crash, of an operation
+// that was never acknowledged, and is cut off. Any other unreadable entry is an error, as skipping it
+// would lose an acknowledged operation.
+func WalReplay() (int, error) {
+	if !walEnabled {
+		return 0, nil
+	}
+	segments, err := walSegments()
+	if err != nil {
+		return 0, err
+	}
+	var replayed []uint64
+	for _, seg := range segments {
+		if seg < walSegment {
+			replayed = append(replayed, seg)
+		}
+	}
+	n := 0
+	for i, seg := range replayed {
+		m, err := walReplaySegment(walSegmentPath(seg), i == len(replayed)-1)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// walReplaySegment applies the entries of a segment, see WalReplay
+func walReplaySegment(path string, last bool) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	n := 0
+	var complete int64 // Size of the complete entries read
+	for line := 1; ; line++ {
+		b, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(b) == 0 {
+				return n, nil
+			}
+			if !last {
+				return n, fmt.Errorf("WAL: %s:%d: incomplete entry before the end of the log", path, line)
+			}
+			LogWarn("WAL: cutting off a torn entry", "file", path, "line", line, "bytes", len(b))
+			return n, os.Truncate(path, complete)
+		}
+		if err != nil {
+			return n, err
+		}
+		var e walEntry
+		if err := json.Unmarshal(b, &e); err != nil {
+			return n, fmt.Errorf("WAL: %s:%d: %w", path, line, err)
+		}
+		applyOperation(&e, true)
+		n++
+		complete += int64(len(b))
+	}
+}
+
+// walRound wraps a round for a walEntry
+func walRound(r *Round) *fileRound {
+	return &fileRound{Key: r.Key, Round: r}
+}
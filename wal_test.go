@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+// walTestLine returns a complete WAL entry creating the user
+func walTestLine(t *testing.T, id uint64) string {
+	b, err := json.Marshal(&walEntry{User: &User{Id: id, Wallets: map[string]*Wallet{"EUR": {Currency: "EUR"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b) + "\n"
+}
+
+// replayTestSegments writes the segments into a new WAL directory and replays them
+func replayTestSegments(t *testing.T, segments ...string) (int, error) {
+	setupTestState(t)
+	dir := t.TempDir()
+	walDir = dir
+	for i, s := range segments {
+		if err := os.WriteFile(walSegmentPath(uint64(i+1)), []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := WalOpen(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		walFile.Close()
+		walEnabled = false
+	})
+	return WalReplay()
+}
+
+func TestWalReplayCutsOffTornLastEntry(t *testing.T) {
+	torn := walTestLine(t, 3)
+	n, err := replayTestSegments(t, walTestLine(t, 1), walTestLine(t, 2)+torn[:len(torn)/2])
+	if err != nil || n != 2 {
+		t.Fatalf("got %d entries, %v; want 2 entries", n, err)
+	}
+	if _, ok := UserRefs[2]; !ok {
+		t.Error("user 2 not replayed")
+	}
+	data, err := os.ReadFile(walSegmentPath(2))
+	if err != nil || string(data) != walTestLine(t, 2) {
+		t.Errorf("the torn entry is not cut off: %q", data)
+	}
+}
+
+func TestWalReplayFailsOnCorruptEntry(t *testing.T) {
+	torn := walTestLine(t, 3)
+	cases := map[string][]string{
+		"corrupt entry in the middle":    {walTestLine(t, 1) + "{garbage}\n" + walTestLine(t, 2)},
+		"corrupt last entry":             {walTestLine(t, 1) + "{garbage}\n"},
+		"torn entry in an older segment": {walTestLine(t, 1) + torn[:len(torn)/2], walTestLine(t, 2)},
+	}
+	for name, segments := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := replayTestSegments(t, segments...); err == nil || !strings.HasPrefix(err.Error(), "WAL: ") {
+				t.Errorf("got %v, want a WAL error", err)
+			}
+		})
+	}
+}
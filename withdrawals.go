@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// withdrawalTransitions lists the statuses a withdrawal can be moved to from each status.
+// "paid" and "rejected" are final.
+var withdrawalTransitions = map[string][]string{
+	"pending":  {"approved", "rejected"},
+	"approved": {"paid", "rejected"},
+}
+
+// clone returns a copy of the withdrawal
+func (w *Withdrawal) clone() *Withdrawal {
+	c := *w
+	return &c
+}
+
+func AddWithdrawal(c *gin.Context) {
+	var input AddWithdrawalInput
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userLock(input.UserId).Lock()
+	defer userLock(input.UserId).Unlock()
+
+	existingUser, isInUserRefs := lookupUser(input.UserId)
+	if !isInUserRefs {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if !reserveId("withdrawal", input.WithdrawalId) {
+		recordRejection(rejectDuplicateId)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A withdrawal with this ID already exists"})
+		return
+	}
+	defer releaseId("withdrawal", input.WithdrawalId)
+
+	user := existingUser.clone()
+	wallet, hasWallet := user.Wallets[input.Currency]
+	if !hasWallet {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User has no wallet in this currency"})
+		return
+	}
+
+	if err := CheckAmount(input.Currency, input.Amount); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if input.Amount < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Amount must be positive"})
+		return
+	}
+
+	if wallet.Balance < input.Amount {
+		recordRejection(rejectInsufficientBalance)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient user balance"})
+		return
+	}
+
+	balanceBefore := wallet.Balance
+	if err := wallet.reserve(input.Amount); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The wallet balance or totals would be out of range"})
+		return
+	}
+
+	newWithdrawal := new(Withdrawal)
+	newWithdrawal.WithdrawalId = input.WithdrawalId
+	newWithdrawal.UserId = input.UserId
+	newWithdrawal.Currency = input.Currency
+	newWithdrawal.Amount = input.Amount
+	newWithdrawal.Status = "pending"
+	newWithdrawal.BalanceBefore = balanceBefore
+	newWithdrawal.BalanceAfter = wallet.Balance
+	newWithdrawal.Time = time.Now()
+	newWithdrawal.UpdatedAt = newWithdrawal.Time
+
+	if !commitOperation(c, &walEntry{User: user, Withdrawal: newWithdrawal}) {
+		return
+	}
+	recordOperation("withdrawal", input.Currency, input.Amount)
+
+	c.JSON(http.StatusCreated, gin.H{"error": "", "balance": wallet.Balance})
+}
+
+func GetWithdrawal(c *gin.Context) {
+	var input GetWithdrawalInput
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	withdrawal, isInWithdrawalRefs := lookupWithdrawal(input.WithdrawalId)
+	if !isInWithdrawalRefs {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Withdrawal not found"})
+		return
+	}
+
+	userLock(withdrawal.UserId).Lock()
+	defer userLock(withdrawal.UserId).Unlock()
+
+	c.IndentedJSON(http.StatusOK, withdrawal)
+}
+
+func SetWithdrawalStatus(c *gin.Context) {
+	var input SetWithdrawalStatusInput
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	existing, isInWithdrawalRefs := lookupWithdrawal(input.WithdrawalId)
+	if !isInWithdrawalRefs {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Withdrawal not found"})
+		return
+	}
+
+	// The user of a withdrawal never changes, so its lock can be taken after the lookup
+	userLock(existing.UserId).Lock()
+	defer userLock(existing.UserId).Unlock()
+
+	withdrawal, _ := lookupWithdrawal(input.WithdrawalId)
+	allowed := false
+	for _, s := range withdrawalTransitions[withdrawal.Status] {
+		if s == input.Status {
+			allowed = true
+		}
+	}
+	if !allowed {
+		c.JSON(http.StatusConflict, gin.H{"error": "Cannot move a " + withdrawal.Status + " withdrawal to " + input.Status})
+		return
+	}
+
+	existingUser, _ := lookupUser(withdrawal.UserId)
+	user := existingUser.clone()
+	wallet := user.Wallets[withdrawal.Currency]
+	switch input.Status {
+	case "paid":
+		wallet.Reserved -= withdrawal.Amount
+	case "rejected":
+		withdrawal.ReleaseBalanceBefore = wallet.Balance
+		if err := wallet.release(withdrawal.Amount); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "The wallet balance or totals would be out of range"})
+			return
+		}
+		withdrawal.ReleaseBalanceAfter = wallet.Balance
+	}
+	withdrawal.Status = input.Status
+	withdrawal.UpdatedAt = time.Now()
+
+	if !commitOperation(c, &walEntry{User: user, Withdrawal: withdrawal}) {
+		return
+	}
+	LogRequest(c, LevelInfo, "Withdrawal status changed", "userid", withdrawal.UserId,
+		"withdrawalid", withdrawal.WithdrawalId, "status", withdrawal.Status)
+
+	c.IndentedJSON(http.StatusOK, withdrawal)
+}